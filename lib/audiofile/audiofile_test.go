@@ -0,0 +1,237 @@
+package audiofile_test
+
+import (
+	"behringerRecorder/lib/audiofile"
+	"behringerRecorder/lib/config"
+	"behringerRecorder/lib/portaudio"
+	"behringerRecorder/lib/types"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const bufferSize = 480
+
+// testSignal returns frames of interleaved samples that are exact at every
+// bit depth the recorder writes: a sawtooth over the 16-bit range, shifted
+// per channel so channel mix-ups show.
+func testSignal(channels, frames int) []float32 {
+	samples := make([]float32, frames*channels)
+	for i := range frames {
+		for c := range channels {
+			samples[i*channels+c] = float32((i*97+c*5000)%65536-32768) / 32768
+		}
+	}
+	return samples
+}
+
+// writeTake records samples into a take of the given format the way the
+// recorder does: CreateTake, the storage worker and FinalizeTake. grow
+// frames of silence are appended to the file before its header is
+// finalized, as a sparse file, for takes too large to write in a test.
+func writeTake(t *testing.T, format types.WavFormat, samples []float32, grow int64) string {
+	t.Helper()
+	ch := format.Channels
+	channels := make([]int, ch)
+	for c := range channels {
+		channels[c] = c
+	}
+	file, _, encoders, err := portaudio.CreateTake(filepath.Join(t.TempDir(), "rec"), 1, channels, false, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := file.Name()
+
+	cfg := &config.Config{SampleRate: format.SampleRate, BufferSize: bufferSize}
+	state := &types.AppState{File: file, Encoders: encoders, FileFormat: format, IsRecording: true}
+	recordChan := make(chan []float32)
+	portaudio.StartStorageWorker(state, cfg, recordChan, nil)
+	for rest := samples; len(rest) > 0; rest = rest[bufferSize*ch:] {
+		recordChan <- rest[:bufferSize*ch]
+	}
+	recordChan <- nil // Handled once the last chunk is written
+	close(recordChan)
+
+	state.Mu.Lock()
+	defer state.Mu.Unlock()
+	frames := state.SamplesWrote
+	if frames != int64(len(samples)/ch) {
+		t.Fatalf("%d frames written, want %d", frames, len(samples)/ch)
+	}
+	if grow > 0 {
+		st, err := file.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Truncate(st.Size() + grow*int64(format.BlockAlign())); err != nil {
+			t.Fatal(err)
+		}
+		frames += grow
+	}
+	if err := portaudio.FinalizeTake(file, nil, encoders, format, frames, nil); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readAll decodes up to limit frames of the file at path (all of them if
+// limit is 0) and returns its header info, the samples and the error that
+// ended decoding, nil at the end of the audio.
+func readAll(t *testing.T, path string, limit int) (audiofile.Info, []float32, error) {
+	t.Helper()
+	r, err := audiofile.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	info := r.Info()
+	var samples []float32
+	buf := make([]float32, 1000*info.Channels)
+	for limit == 0 || len(samples) < limit*info.Channels {
+		n, err := r.Read(buf)
+		samples = append(samples, buf[:n*info.Channels]...)
+		if err == io.EOF {
+			return info, samples, nil
+		}
+		if err != nil {
+			return info, samples, err
+		}
+	}
+	return info, samples[:limit*info.Channels], nil
+}
+
+// firstMismatch returns the index of the first sample that differs, or -1.
+func firstMismatch(got, want []float32) int {
+	for i := range min(len(got), len(want)) {
+		if got[i] != want[i] {
+			return i
+		}
+	}
+	if len(got) != len(want) {
+		return min(len(got), len(want))
+	}
+	return -1
+}
+
+func TestReadTakes(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format types.WavFormat
+		magic  string // First four bytes of the file
+		grow   int64
+	}{
+		{"16-bit stereo", types.WavFormat{Channels: 2, BitDepth: 16}, "RIFF", 0},
+		{"24-bit stereo", types.WavFormat{Channels: 2, BitDepth: 24}, "RIFF", 0},
+		{"32-bit float stereo", types.WavFormat{Channels: 2, BitDepth: 32, Float: true}, "RIFF", 0},
+		{"16-bit 4 channels extensible", types.WavFormat{Channels: 4, BitDepth: 16}, "RIFF", 0},
+		{"32-bit float 6 channels extensible", types.WavFormat{Channels: 6, BitDepth: 32, Float: true}, "RIFF", 0},
+		// Data past 4 GB: RF64 with the sizes in the ds64 chunk
+		{"RF64 16-bit mono", types.WavFormat{Channels: 1, BitDepth: 16}, "RF64", 1<<31 + 1000},
+		{"FLAC 16-bit stereo", types.WavFormat{Channels: 2, BitDepth: 16, Flac: true}, "fLaC", 0},
+		{"FLAC 24-bit 3 channels", types.WavFormat{Channels: 3, BitDepth: 24, Flac: true}, "fLaC", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.format.SampleRate = 48000
+			const frames = 10 * bufferSize
+			want := testSignal(tc.format.Channels, frames)
+			path := writeTake(t, tc.format, want, tc.grow)
+
+			data := make([]byte, 4)
+			if f, err := os.Open(path); err != nil {
+				t.Fatal(err)
+			} else {
+				f.Read(data)
+				f.Close()
+			}
+			if string(data) != tc.magic {
+				t.Fatalf("file starts with %q, want %q", data, tc.magic)
+			}
+
+			// Of a grown take, only the frames written are checked
+			info, got, err := readAll(t, path, frames)
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			wantFormat := "wav"
+			if tc.format.Flac {
+				wantFormat = "flac"
+			}
+			wantInfo := audiofile.Info{
+				Format:     wantFormat,
+				Channels:   tc.format.Channels,
+				SampleRate: 48000,
+				BitDepth:   tc.format.BitDepth,
+				Float:      tc.format.Float,
+				Frames:     frames + tc.grow,
+			}
+			if info != wantInfo {
+				t.Errorf("header says %+v, want %+v", info, wantInfo)
+			}
+			if i := firstMismatch(got, want); i >= 0 {
+				t.Fatalf("sample %d (frame %d) differs, %d samples decoded, want %d", i, i/tc.format.Channels, len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestReadDamagedTakes(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format types.WavFormat
+		damage func([]byte) []byte
+		frames int    // Frames that still decode
+		err    string // Error decoding ends with, "" for a clean end
+	}{
+		{
+			// Cut in the middle of a frame: the whole frames before it
+			// are read, the header's length notwithstanding
+			"WAV cut mid-frame",
+			types.WavFormat{Channels: 2, BitDepth: 24},
+			func(b []byte) []byte { return b[:len(b)-1000*6-5] },
+			10*bufferSize - 1001,
+			"",
+		},
+		{
+			// Cut in the last frame: the frames before it decode
+			"FLAC cut",
+			types.WavFormat{Channels: 2, BitDepth: 16, Flac: true},
+			func(b []byte) []byte { return b[:len(b)-100] },
+			4096,
+			"unexpected EOF",
+		},
+		{
+			// A damaged CRC-16 at the end of the last frame
+			"FLAC CRC mismatch",
+			types.WavFormat{Channels: 2, BitDepth: 16, Flac: true},
+			func(b []byte) []byte { b[len(b)-1] ^= 0x01; return b },
+			4096,
+			"CRC mismatch",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.format.SampleRate = 48000
+			want := testSignal(tc.format.Channels, 10*bufferSize)
+			path := writeTake(t, tc.format, want, 0)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tc.damage(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, got, err := readAll(t, path, 0)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("decoding: %v", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("decoding ended with %v, want %q", err, tc.err)
+			}
+			if i := firstMismatch(got, want[:tc.frames*tc.format.Channels]); i >= 0 {
+				t.Fatalf("sample %d differs, %d samples decoded, want %d", i, len(got), tc.frames*tc.format.Channels)
+			}
+		})
+	}
+}
@@ -0,0 +1,551 @@
+package audiofile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// flacDecoder decodes the frames of a FLAC stream. It supports everything
+// the format allows for 4 to 32 bits per sample: CONSTANT, VERBATIM, FIXED
+// and LPC subframes, wasted bits, all stereo decorrelation modes, fixed and
+// variable block sizes. Frame header (CRC-8) and frame (CRC-16) checksums
+// are verified; the MD5 of the whole stream is not.
+type flacDecoder struct {
+	f          *os.File
+	br         *bitReader
+	audioStart int64 // Offset of the first frame
+	channels   int
+	bits       int
+	scale      float32
+
+	block [][]int64 // Decoded channels of the current frame
+	pos   int       // Next frame of block to return
+	size  int       // Frames in block
+}
+
+// newFlacDecoder parses the metadata blocks. STREAMINFO must come first:
+//
+//	Offset  Size  Field
+//	0       4     "fLaC"
+//	4       4     Block header: last-block flag (1 bit), type 0 (7), length 34 (24)
+//	8       4     Min/max block size (16 bits each)
+//	12      6     Min/max frame size (24 bits each)
+//	18      8     Sample rate (20 bits), channels-1 (3), bits-1 (5), total samples (36)
+//	26      16    MD5 of the decoded audio
+//
+// The other metadata blocks are skipped.
+func newFlacDecoder(f *os.File) (*flacDecoder, Info, error) {
+	info := Info{Format: "flac"}
+	var head [42]byte
+	if _, err := io.ReadFull(f, head[:]); err != nil {
+		return nil, info, err
+	}
+	if head[4]&0x7F != 0 || binary.BigEndian.Uint32(head[4:8])&0xFFFFFF != 34 {
+		return nil, info, fmt.Errorf("missing STREAMINFO block")
+	}
+	v := binary.BigEndian.Uint64(head[18:26])
+	info.SampleRate = int(v >> 44)
+	info.Channels = int(v>>41&0x7) + 1
+	info.BitDepth = int(v>>36&0x1F) + 1
+	info.Frames = int64(v & (1<<36 - 1))
+	if info.SampleRate == 0 || info.BitDepth < 4 {
+		return nil, info, fmt.Errorf("invalid STREAMINFO block")
+	}
+
+	d := &flacDecoder{
+		f:        f,
+		channels: info.Channels,
+		bits:     info.BitDepth,
+		scale:    1 / float32(uint64(1)<<(info.BitDepth-1)),
+	}
+	offset := int64(len(head))
+	last := head[4]&0x80 != 0
+	for !last {
+		var hdr [4]byte
+		if _, err := f.ReadAt(hdr[:], offset); err != nil {
+			return nil, info, fmt.Errorf("truncated metadata")
+		}
+		last = hdr[0]&0x80 != 0
+		offset += 4 + int64(binary.BigEndian.Uint32(hdr[:])&0xFFFFFF)
+	}
+	d.audioStart = offset
+	d.block = make([][]int64, d.channels)
+	return d, info, d.rewind()
+}
+
+func (d *flacDecoder) rewind() error {
+	r, err := newBufferedReader(d.f, d.audioStart)
+	if err != nil {
+		return err
+	}
+	d.br = &bitReader{r: r}
+	d.pos, d.size = 0, 0
+	return nil
+}
+
+func (d *flacDecoder) read(dst []float32) (int, error) {
+	frames := len(dst) / d.channels
+	n := 0
+	for n < frames {
+		if d.pos == d.size {
+			if err := d.decodeFrame(); err == io.EOF {
+				break
+			} else if err != nil {
+				return n, err
+			}
+		}
+		k := min(frames-n, d.size-d.pos)
+		for i := range k {
+			for c := range d.channels {
+				dst[(n+i)*d.channels+c] = float32(d.block[c][d.pos+i]) * d.scale
+			}
+		}
+		n += k
+		d.pos += k
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+var errFlacSync = errors.New("lost frame sync")
+
+// decodeFrame decodes the next frame into d.block. It returns io.EOF at the
+// end of the stream.
+//
+//	Frame header:
+//	14 bits  sync code 0b11111111111110
+//	1        reserved
+//	1        blocking strategy (0 fixed, 1 variable block size)
+//	4        block size code
+//	4        sample rate code
+//	4        channel assignment (0-7 independent, 8 left/side, 9 side/right, 10 mid/side)
+//	3        sample size code
+//	1        reserved
+//	1-7 B    frame or sample number, UTF-8 style coded
+//	0-2 B    block size, if the code says so
+//	0-2 B    sample rate, if the code says so
+//	1 B      CRC-8 of the header
+//	Then one subframe per channel, padding to a byte, and the CRC-16 of
+//	the frame.
+func (d *flacDecoder) decodeFrame() error {
+	br := d.br
+	br.resetCRC()
+	sync, err := br.bits(15)
+	if err == io.EOF && br.n == 0 {
+		return io.EOF
+	} else if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if sync != 0x7FFC {
+		return errFlacSync
+	}
+	br.bits(1) // blocking strategy
+	bsCode, _ := br.bits(4)
+	rateCode, _ := br.bits(4)
+	assignment, _ := br.bits(4)
+	sizeCode, _ := br.bits(3)
+	br.bits(1)
+	if err := br.skipUTF8(); err != nil {
+		return err
+	}
+
+	var size int
+	switch {
+	case bsCode == 1:
+		size = 192
+	case bsCode >= 2 && bsCode <= 5:
+		size = 576 << (bsCode - 2)
+	case bsCode == 6:
+		v, _ := br.bits(8)
+		size = int(v) + 1
+	case bsCode == 7:
+		v, _ := br.bits(16)
+		size = int(v) + 1
+	case bsCode >= 8:
+		size = 256 << (bsCode - 8)
+	default:
+		return fmt.Errorf("reserved block size")
+	}
+	switch rateCode {
+	case 12:
+		br.bits(8)
+	case 13, 14:
+		br.bits(16)
+	case 15:
+		return fmt.Errorf("invalid sample rate code")
+	}
+	bps := d.bits
+	if sizeCode != 0 {
+		bps = []int{0, 8, 12, 0, 16, 20, 24, 32}[sizeCode]
+		if bps == 0 {
+			return fmt.Errorf("reserved sample size")
+		}
+	}
+	crc := br.crc8
+	if v, err := br.bits(8); err != nil {
+		return io.ErrUnexpectedEOF
+	} else if byte(v) != crc {
+		return fmt.Errorf("frame header CRC mismatch")
+	}
+
+	channels := d.channels
+	if assignment >= 8 {
+		if assignment > 10 || channels != 2 {
+			return fmt.Errorf("invalid channel assignment %d", assignment)
+		}
+	} else if int(assignment)+1 != channels {
+		return fmt.Errorf("frame has %d channels, stream %d", assignment+1, channels)
+	}
+	for c := range channels {
+		if cap(d.block[c]) < size {
+			d.block[c] = make([]int64, size)
+		}
+		d.block[c] = d.block[c][:size]
+		// The side channel needs one bit more
+		extra := 0
+		if assignment == 8 && c == 1 || assignment == 9 && c == 0 || assignment == 10 && c == 1 {
+			extra = 1
+		}
+		if err := d.decodeSubframe(d.block[c], bps+extra); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+
+	left, right := d.block[0], d.block[min(1, channels-1)]
+	switch assignment {
+	case 8: // left, side = left - right
+		for i := range size {
+			right[i] = left[i] - right[i]
+		}
+	case 9: // side, right
+		for i := range size {
+			left[i] += right[i]
+		}
+	case 10: // mid = (left + right) >> 1, side = left - right
+		for i := range size {
+			mid := left[i]<<1 | right[i]&1
+			left[i], right[i] = (mid+right[i])>>1, (mid-right[i])>>1
+		}
+	}
+
+	br.align()
+	crc16 := br.crc16
+	if v, err := br.bits(16); err != nil {
+		return io.ErrUnexpectedEOF
+	} else if uint16(v) != crc16 {
+		return fmt.Errorf("frame CRC mismatch")
+	}
+	d.pos, d.size = 0, size
+	return nil
+}
+
+// fixedCoefficients are the predictors of the FIXED subframes by order.
+var fixedCoefficients = [][]int64{{}, {1}, {2, -1}, {3, -3, 1}, {4, -6, 4, -1}}
+
+// decodeSubframe decodes one channel of a frame into out:
+//
+//	1 bit   zero padding
+//	6       type: 000000 CONSTANT, 000001 VERBATIM, 001xxx FIXED of order xxx,
+//	        1xxxxx LPC of order xxxxx+1
+//	1       wasted bits flag, followed by their count-1 in unary
+func (d *flacDecoder) decodeSubframe(out []int64, bps int) error {
+	br := d.br
+	head, err := br.bits(8)
+	if err != nil {
+		return err
+	}
+	if head&0x80 != 0 {
+		return fmt.Errorf("invalid subframe header")
+	}
+	wasted := 0
+	if head&1 != 0 {
+		k, err := br.unary()
+		if err != nil {
+			return err
+		}
+		wasted = int(k) + 1
+		bps -= wasted
+	}
+	if bps <= 0 {
+		return fmt.Errorf("invalid wasted bits")
+	}
+
+	switch kind := head >> 1 & 0x3F; {
+	case kind == 0:
+		v, err := br.signed(bps)
+		if err != nil {
+			return err
+		}
+		for i := range out {
+			out[i] = v
+		}
+	case kind == 1:
+		for i := range out {
+			if out[i], err = br.signed(bps); err != nil {
+				return err
+			}
+		}
+	case kind >= 8 && kind <= 12:
+		order := int(kind - 8)
+		if err := d.decodePredicted(out, bps, order, fixedCoefficients[order], 0); err != nil {
+			return err
+		}
+	case kind >= 32:
+		order := int(kind-32) + 1
+		warmup := make([]int64, order)
+		for i := range warmup {
+			if warmup[i], err = br.signed(bps); err != nil {
+				return err
+			}
+		}
+		precision, _ := br.bits(4)
+		if precision == 15 {
+			return fmt.Errorf("invalid LPC precision")
+		}
+		shift, err := br.signed(5)
+		if err != nil {
+			return err
+		}
+		if shift < 0 {
+			return fmt.Errorf("negative LPC shift")
+		}
+		coefs := make([]int64, order)
+		for i := range coefs {
+			if coefs[i], err = br.signed(int(precision) + 1); err != nil {
+				return err
+			}
+		}
+		copy(out, warmup)
+		if err := d.decodePredicted(out, bps, -order, coefs, int(shift)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("reserved subframe type %d", kind)
+	}
+
+	if wasted > 0 {
+		for i := range out {
+			out[i] <<= wasted
+		}
+	}
+	return nil
+}
+
+// decodePredicted reads the warm-up samples (FIXED, order > 0; LPC passes
+// -order as they are already in out), the residual, and restores the signal:
+//
+//	out[i] = residual[i] + (sum of coefs[j] * out[i-1-j]) >> shift
+func (d *flacDecoder) decodePredicted(out []int64, bps, order int, coefs []int64, shift int) error {
+	if order < 0 {
+		order = -order
+	} else {
+		for i := range order {
+			v, err := d.br.signed(bps)
+			if err != nil {
+				return err
+			}
+			out[i] = v
+		}
+	}
+	if order > len(out) {
+		return fmt.Errorf("predictor order exceeds block size")
+	}
+	if err := d.decodeResidual(out[order:], len(out), order); err != nil {
+		return err
+	}
+	for i := order; i < len(out); i++ {
+		var sum int64
+		for j, c := range coefs {
+			sum += c * out[i-1-j]
+		}
+		out[i] += sum >> shift
+	}
+	return nil
+}
+
+// decodeResidual reads the Rice coded residual of a subframe into res:
+//
+//	2 bits  method: 0 = 4-bit Rice parameters, 1 = 5-bit
+//	4       partition order p: 2^p partitions of blockSize/2^p samples each,
+//	        the first one shorter by the predictor order
+//	Per partition: the parameter k, or the escape code (all ones) followed
+//	by 5 bits n and raw signed n-bit samples; then per sample a unary
+//	quotient and k low bits of the zigzag coded value.
+func (d *flacDecoder) decodeResidual(res []int64, blockSize, order int) error {
+	br := d.br
+	method, err := br.bits(2)
+	if err != nil {
+		return err
+	}
+	if method > 1 {
+		return fmt.Errorf("reserved residual coding method")
+	}
+	paramBits := 4 + int(method)
+	escape := uint64(1)<<paramBits - 1
+	partOrder, _ := br.bits(4)
+	parts := 1 << partOrder
+	if blockSize%parts != 0 || blockSize/parts < order {
+		return fmt.Errorf("invalid partition order")
+	}
+	i := 0
+	for p := range parts {
+		n := blockSize / parts
+		if p == 0 {
+			n -= order
+		}
+		k, err := br.bits(uint(paramBits))
+		if err != nil {
+			return err
+		}
+		if k == escape {
+			raw, _ := br.bits(5)
+			for range n {
+				if res[i], err = br.signed(int(raw)); err != nil {
+					return err
+				}
+				i++
+			}
+			continue
+		}
+		for range n {
+			q, err := br.unary()
+			if err != nil {
+				return err
+			}
+			low, err := br.bits(uint(k))
+			if err != nil {
+				return err
+			}
+			u := q<<k | low
+			res[i] = int64(u>>1) ^ -int64(u&1)
+			i++
+		}
+	}
+	return nil
+}
+
+// bitReader reads big-endian bit fields one byte at a time, keeping the
+// CRC-8 and CRC-16 of the bytes read since resetCRC.
+type bitReader struct {
+	r     *bufio.Reader
+	cache uint64 // The low n bits are the next bits of the stream
+	n     uint
+	crc8  byte
+	crc16 uint16
+}
+
+func (b *bitReader) resetCRC() {
+	b.crc8, b.crc16 = 0, 0
+}
+
+func (b *bitReader) fill() error {
+	c, err := b.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	b.cache = b.cache<<8 | uint64(c)
+	b.n += 8
+	b.crc8 = crc8Table[b.crc8^c]
+	b.crc16 = b.crc16<<8 ^ crc16Table[byte(b.crc16>>8)^c]
+	return nil
+}
+
+// bits reads an n-bit unsigned value, n <= 56.
+func (b *bitReader) bits(n uint) (uint64, error) {
+	for b.n < n {
+		if err := b.fill(); err != nil {
+			return 0, err
+		}
+	}
+	b.n -= n
+	return b.cache >> b.n & (1<<n - 1), nil
+}
+
+// signed reads an n-bit two's complement value.
+func (b *bitReader) signed(n int) (int64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	v, err := b.bits(uint(n))
+	return int64(v<<(64-n)) >> (64 - n), err
+}
+
+// unary counts zero bits up to the next one bit.
+func (b *bitReader) unary() (uint64, error) {
+	var count uint64
+	for {
+		if b.n == 0 {
+			if err := b.fill(); err != nil {
+				return 0, err
+			}
+		}
+		rest := b.cache & (1<<b.n - 1)
+		if rest == 0 {
+			count += uint64(b.n)
+			b.n = 0
+			continue
+		}
+		zeros := b.n - uint(bits.Len64(rest))
+		count += uint64(zeros)
+		b.n -= zeros + 1
+		return count, nil
+	}
+}
+
+// align skips to the next byte boundary.
+func (b *bitReader) align() {
+	b.n -= b.n % 8
+}
+
+// skipUTF8 skips the frame or sample number, coded like UTF-8 with up to 7
+// bytes.
+func (b *bitReader) skipUTF8() error {
+	first, err := b.bits(8)
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	extra := bits.LeadingZeros8(^byte(first))
+	if extra == 1 || extra > 7 {
+		return errFlacSync
+	}
+	for range max(extra-1, 0) {
+		if _, err := b.bits(8); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
+
+var (
+	crc8Table  [256]byte   // Polynomial x^8 + x^2 + x + 1
+	crc16Table [256]uint16 // Polynomial x^16 + x^15 + x^2 + 1
+)
+
+func init() {
+	for i := range 256 {
+		c8, c16 := byte(i), uint16(i)<<8
+		for range 8 {
+			if c8&0x80 != 0 {
+				c8 = c8<<1 ^ 0x07
+			} else {
+				c8 <<= 1
+			}
+			if c16&0x8000 != 0 {
+				c16 = c16<<1 ^ 0x8005
+			} else {
+				c16 <<= 1
+			}
+		}
+		crc8Table[i], crc16Table[i] = c8, c16
+	}
+}
@@ -0,0 +1,269 @@
+package audiofile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// PeakBaseZoom is the samples per pixel of the finest peak level.
+	PeakBaseZoom = 256
+	// peakMaxLength ends the levels: each level halves the one before until
+	// it is at most this many pixels, enough for an overview of any take.
+	peakMaxLength = 1024
+	peakMagic     = "PEAK"
+)
+
+// PeakLevel is the waveform of a recording at one zoom: the lowest and
+// highest sample of every channel in each run of SamplesPerPixel frames,
+// scaled to 16 bits. It is the data of an audiowaveform .dat file.
+type PeakLevel struct {
+	SampleRate      int
+	Channels        int
+	SamplesPerPixel int
+	Data            []int16 // Per pixel, per channel: min, max
+}
+
+// Length returns the number of pixels.
+func (l *PeakLevel) Length() int {
+	return len(l.Data) / (2 * l.Channels)
+}
+
+// WriteTo writes the level as an audiowaveform version 2 .dat file, all
+// fields little-endian:
+//
+//	Offset  Size  Field
+//	0       4     Version (2)
+//	4       4     Flags (0: 16-bit data)
+//	8       4     Sample rate
+//	12      4     Samples per pixel
+//	16      4     Length in pixels
+//	20      4     Channels
+//	24      ...   Data: int16 min, max per channel per pixel
+func (l *PeakLevel) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 24+2*len(l.Data))
+	for i, v := range []int{2, 0, l.SampleRate, l.SamplesPerPixel, l.Length(), l.Channels} {
+		binary.LittleEndian.PutUint32(buf[i*4:], uint32(v))
+	}
+	for i, v := range l.Data {
+		binary.LittleEndian.PutUint16(buf[24+i*2:], uint16(v))
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func readPeakLevel(r io.Reader) (*PeakLevel, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	field := func(i int) int { return int(binary.LittleEndian.Uint32(hdr[i*4:])) }
+	l := &PeakLevel{SampleRate: field(2), SamplesPerPixel: field(3), Channels: field(5)}
+	length := field(4)
+	if field(0) != 2 || field(1) != 0 || l.Channels < 1 || l.Channels > 256 ||
+		l.SamplesPerPixel < 1 || length > 1<<30/l.Channels {
+		return nil, fmt.Errorf("invalid peak level")
+	}
+	raw := make([]byte, 4*length*l.Channels)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	l.Data = make([]int16, len(raw)/2)
+	for i := range l.Data {
+		l.Data[i] = int16(binary.LittleEndian.Uint16(raw[i*2:]))
+	}
+	return l, nil
+}
+
+// Peaks is the waveform of a recording at several zooms, for drawing it
+// without reading the audio. Levels start at PeakBaseZoom samples per pixel
+// and each one is half as detailed as the one before.
+type Peaks struct {
+	Frames int64 // Length of the recording in sample frames
+	Levels []*PeakLevel
+}
+
+// Level returns the waveform at zoom samples per pixel (at least
+// PeakBaseZoom), merged from the closest stored level. Zoom 0 returns the
+// coarsest stored level.
+func (p *Peaks) Level(zoom int) (*PeakLevel, error) {
+	if zoom == 0 {
+		return p.Levels[len(p.Levels)-1], nil
+	}
+	if zoom < PeakBaseZoom {
+		return nil, fmt.Errorf("zoom must be at least %d samples per pixel", PeakBaseZoom)
+	}
+	src := p.Levels[0]
+	for _, l := range p.Levels[1:] {
+		if l.SamplesPerPixel <= zoom {
+			src = l
+		}
+	}
+	if src.SamplesPerPixel == zoom {
+		return src, nil
+	}
+
+	ch := src.Channels
+	length := int((p.Frames + int64(zoom) - 1) / int64(zoom))
+	out := &PeakLevel{
+		SampleRate:      src.SampleRate,
+		Channels:        ch,
+		SamplesPerPixel: zoom,
+		Data:            make([]int16, 2*ch*length),
+	}
+	for i := range length {
+		first := i * zoom / src.SamplesPerPixel
+		last := min(((i+1)*zoom-1)/src.SamplesPerPixel, src.Length()-1)
+		for c := range ch {
+			lo, hi := int16(math.MaxInt16), int16(math.MinInt16)
+			for j := first; j <= last; j++ {
+				lo = min(lo, src.Data[(j*ch+c)*2])
+				hi = max(hi, src.Data[(j*ch+c)*2+1])
+			}
+			out.Data[(i*ch+c)*2] = lo
+			out.Data[(i*ch+c)*2+1] = hi
+		}
+	}
+	return out, nil
+}
+
+// WriteTo writes all levels, little-endian:
+//
+//	Offset  Size  Field
+//	0       4     "PEAK"
+//	4       4     Number of levels
+//	8       8     Frames
+//	16      ...   Levels, each an audiowaveform .dat (see PeakLevel.WriteTo)
+func (p *Peaks) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var hdr [16]byte
+	copy(hdr[:], peakMagic)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(p.Levels)))
+	binary.LittleEndian.PutUint64(hdr[8:], uint64(p.Frames))
+	written, _ := bw.Write(hdr[:])
+	total := int64(written)
+	for _, l := range p.Levels {
+		n, err := l.WriteTo(bw)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, bw.Flush()
+}
+
+// ReadPeaks reads peaks written by Peaks.WriteTo.
+func ReadPeaks(r io.Reader) (*Peaks, error) {
+	br := bufio.NewReader(r)
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil || string(hdr[:4]) != peakMagic {
+		return nil, fmt.Errorf("not a peak file")
+	}
+	count := int(binary.LittleEndian.Uint32(hdr[4:]))
+	if count < 1 || count > 32 {
+		return nil, fmt.Errorf("invalid peak file")
+	}
+	p := &Peaks{Frames: int64(binary.LittleEndian.Uint64(hdr[8:]))}
+	for range count {
+		l, err := readPeakLevel(br)
+		if err != nil {
+			return nil, err
+		}
+		p.Levels = append(p.Levels, l)
+	}
+	return p, nil
+}
+
+// PeakBuilder computes the Peaks of audio fed to it block by block.
+type PeakBuilder struct {
+	channels   int
+	sampleRate int
+	frames     int64
+	lo, hi     []float32 // Of the pixel being filled
+	fill       int       // Frames in the pixel being filled
+	data       []int16
+}
+
+// NewPeakBuilder starts the peaks of audio with the given format.
+func NewPeakBuilder(channels, sampleRate int) *PeakBuilder {
+	return &PeakBuilder{
+		channels:   channels,
+		sampleRate: sampleRate,
+		lo:         make([]float32, channels),
+		hi:         make([]float32, channels),
+	}
+}
+
+// Add takes interleaved frames, as returned by Reader.Read.
+func (b *PeakBuilder) Add(frames []float32) {
+	for i := 0; i+b.channels <= len(frames); i += b.channels {
+		for c, s := range frames[i : i+b.channels] {
+			if b.fill == 0 {
+				b.lo[c], b.hi[c] = s, s
+			} else {
+				b.lo[c], b.hi[c] = min(b.lo[c], s), max(b.hi[c], s)
+			}
+		}
+		b.frames++
+		if b.fill++; b.fill == PeakBaseZoom {
+			b.flush()
+		}
+	}
+}
+
+// flush ends the pixel being filled.
+func (b *PeakBuilder) flush() {
+	for c := range b.channels {
+		b.data = append(b.data, toPeak(b.lo[c]), toPeak(b.hi[c]))
+	}
+	b.fill = 0
+}
+
+func toPeak(s float32) int16 {
+	return int16(max(-32768, min(32767, math.Round(float64(s)*32767))))
+}
+
+// Peaks ends the audio and returns its peaks at all levels.
+func (b *PeakBuilder) Peaks() *Peaks {
+	if b.fill > 0 {
+		b.flush()
+	}
+	l := &PeakLevel{
+		SampleRate:      b.sampleRate,
+		Channels:        b.channels,
+		SamplesPerPixel: PeakBaseZoom,
+		Data:            b.data,
+	}
+	p := &Peaks{Frames: b.frames, Levels: []*PeakLevel{l}}
+	for l.Length() > peakMaxLength {
+		l = halve(l)
+		p.Levels = append(p.Levels, l)
+	}
+	return p
+}
+
+// halve merges each pair of pixels of l.
+func halve(l *PeakLevel) *PeakLevel {
+	ch := l.Channels
+	length := (l.Length() + 1) / 2
+	out := &PeakLevel{
+		SampleRate:      l.SampleRate,
+		Channels:        ch,
+		SamplesPerPixel: l.SamplesPerPixel * 2,
+		Data:            make([]int16, 2*ch*length),
+	}
+	for i := range length {
+		for c := range ch {
+			lo, hi := l.Data[(2*i*ch+c)*2], l.Data[(2*i*ch+c)*2+1]
+			if next := (2*i+1)*ch + c; next*2 < len(l.Data) {
+				lo, hi = min(lo, l.Data[next*2]), max(hi, l.Data[next*2+1])
+			}
+			out.Data[(i*ch+c)*2] = lo
+			out.Data[(i*ch+c)*2+1] = hi
+		}
+	}
+	return out
+}
@@ -0,0 +1,174 @@
+package audiofile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// wavDecoder reads the data chunk of a WAV or RF64 file.
+type wavDecoder struct {
+	f         *os.File
+	r         *bufio.Reader
+	channels  int
+	bits      int
+	float     bool
+	dataStart int64
+	dataSize  int64
+	remaining int64
+	raw       []byte
+}
+
+// newWavDecoder walks the RIFF chunk list for "ds64", "fmt " and "data":
+//
+//	Offset  Size  Field
+//	0       4     "RIFF" (or "RF64", whose sizes are in the ds64 chunk)
+//	4       4     File size - 8
+//	8       4     "WAVE"
+//	12      ...   Chunks: 4-byte ID, 4-byte size, body padded to even size
+func newWavDecoder(f *os.File) (*wavDecoder, Info, error) {
+	info := Info{Format: "wav"}
+	var riff [12]byte
+	if _, err := io.ReadFull(f, riff[:]); err != nil {
+		return nil, info, err
+	}
+	if string(riff[8:12]) != "WAVE" {
+		return nil, info, fmt.Errorf("not a RIFF/WAVE file")
+	}
+	d := &wavDecoder{f: f}
+	r := bufio.NewReader(f)
+
+	offset := int64(12)
+	haveFmt := false
+	var ds64DataSize int64
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, info, fmt.Errorf("no data chunk")
+		}
+		id := string(hdr[0:4])
+		size := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+		offset += 8
+
+		switch id {
+		case "ds64":
+			body := make([]byte, size)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return nil, info, err
+			}
+			if size >= 16 {
+				ds64DataSize = int64(binary.LittleEndian.Uint64(body[8:16]))
+			}
+		case "fmt ":
+			if size < 16 || size > 1024 {
+				return nil, info, fmt.Errorf("invalid fmt chunk")
+			}
+			body := make([]byte, size)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return nil, info, err
+			}
+			format := binary.LittleEndian.Uint16(body[0:2])
+			d.channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			info.SampleRate = int(binary.LittleEndian.Uint32(body[4:8]))
+			d.bits = int(binary.LittleEndian.Uint16(body[14:16]))
+			// WAVE_FORMAT_EXTENSIBLE keeps the real format tag at the
+			// start of the SubFormat GUID.
+			if format == 0xFFFE && size >= 26 {
+				format = binary.LittleEndian.Uint16(body[24:26])
+			}
+			switch {
+			case format == 1 && (d.bits == 16 || d.bits == 24 || d.bits == 32):
+			case format == 3 && d.bits == 32:
+				d.float = true
+			default:
+				return nil, info, fmt.Errorf("unsupported WAV encoding (format %d, %d bits)", format, d.bits)
+			}
+			if d.channels == 0 || info.SampleRate == 0 {
+				return nil, info, fmt.Errorf("invalid channel count or sample rate")
+			}
+			haveFmt = true
+		case "data":
+			if !haveFmt {
+				return nil, info, fmt.Errorf("data chunk before fmt chunk")
+			}
+			d.dataStart = offset
+			if size == 0xFFFFFFFF && ds64DataSize > 0 {
+				size = ds64DataSize
+			}
+			d.dataSize = size
+			if st, err := f.Stat(); err == nil && (size == 0 || offset+size > st.Size()) {
+				// Unfinalized or truncated take: use what is on disk.
+				d.dataSize = st.Size() - offset
+			}
+			frameBytes := int64(d.channels * d.bits / 8)
+			d.dataSize -= d.dataSize % frameBytes
+			info.Channels = d.channels
+			info.BitDepth = d.bits
+			info.Float = d.float
+			info.Frames = d.dataSize / frameBytes
+			return d, info, d.rewind()
+		default:
+			if _, err := r.Discard(int(size + size%2)); err != nil {
+				return nil, info, fmt.Errorf("no data chunk")
+			}
+		}
+		offset += size + size%2
+	}
+}
+
+func (d *wavDecoder) rewind() error {
+	r, err := newBufferedReader(d.f, d.dataStart)
+	if err != nil {
+		return err
+	}
+	d.r = r
+	d.remaining = d.dataSize
+	return nil
+}
+
+func (d *wavDecoder) read(dst []float32) (int, error) {
+	frameBytes := d.channels * d.bits / 8
+	n := min(int64(len(dst)/d.channels), d.remaining/int64(frameBytes))
+	if n == 0 {
+		return 0, io.EOF
+	}
+	size := int(n) * frameBytes
+	if cap(d.raw) < size {
+		d.raw = make([]byte, size)
+	}
+	raw := d.raw[:size]
+	if _, err := io.ReadFull(d.r, raw); err != nil {
+		d.remaining = 0
+		return 0, err
+	}
+	d.remaining -= int64(size)
+	d.decode(dst[:int(n)*d.channels], raw)
+	return int(n), nil
+}
+
+// decode converts little-endian samples to float32 in [-1.0, 1.0].
+func (d *wavDecoder) decode(dst []float32, raw []byte) {
+	switch {
+	case d.float:
+		for i := range dst {
+			dst[i] = math.Float32frombits(binary.LittleEndian.Uint32(raw[i*4:]))
+		}
+	case d.bits == 16:
+		for i := range dst {
+			dst[i] = float32(int16(binary.LittleEndian.Uint16(raw[i*2:]))) / 32768
+		}
+	case d.bits == 24:
+		for i := range dst {
+			b := raw[i*3:]
+			v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			dst[i] = float32(v) / 8388608
+		}
+	case d.bits == 32:
+		for i := range dst {
+			dst[i] = float32(float64(int32(binary.LittleEndian.Uint32(raw[i*4:]))) / 2147483648)
+		}
+	}
+}
@@ -15,6 +15,42 @@ type Config struct {
 	DefaultChL         int     `yaml:"default_ch_l"`
 	DefaultChR         int     `yaml:"default_ch_r"`
 	DefaultBoost       float64 `yaml:"default_boost"`
+	DefaultChannels    []int   `yaml:"default_channels"`
+	SplitTracks        bool    `yaml:"split_tracks"`
+	FileNameTemplate   string  `yaml:"file_name_template"` // Take name, see portaudio.ExpandNameTemplate
+	PreRollSeconds     float64 `yaml:"pre_roll_seconds"`
+	CueOnResume        bool    `yaml:"cue_on_resume"`
+	SplitEveryMinutes  float64 `yaml:"split_every_minutes"` // Start a new file part after this long (0 = never)
+	SplitEveryMB       float64 `yaml:"split_every_mb"`      // Start a new file part at this size (0 = never)
+	FileFormat         string  `yaml:"file_format"`         // "wav" (default) or "flac"
+	BitDepth           string  `yaml:"bit_depth"`           // "16" (default), "24" or "32f"
+	Dither             string  `yaml:"dither"`              // "none" (default), "tpdf" or "shaped"
+
+	// Look-ahead limiter after the boost instead of clipping at full scale
+	Limiter          bool    `yaml:"limiter"`
+	LimiterCeiling   float64 `yaml:"limiter_ceiling"`    // dBFS, -20 to 0
+	LimiterReleaseMs float64 `yaml:"limiter_release_ms"` // 0 uses 50
+
+	// Broadcast Wave (bext chunk) metadata; an empty originator uses the device name
+	Bwf                    bool   `yaml:"bwf"`
+	BwfDescription         string `yaml:"bwf_description"`
+	BwfOriginator          string `yaml:"bwf_originator"`
+	BwfOriginatorReference string `yaml:"bwf_originator_reference"`
+
+	// Crash safety: interval of header updates while recording (0 disables)
+	HeaderUpdateSeconds float64 `yaml:"header_update_seconds"`
+
+	// Audio source backend: "portaudio" (default), "synthetic" or "file".
+	Source             string   `yaml:"source"`
+	SyntheticSignals   []string `yaml:"synthetic_signals"`
+	SyntheticAmplitude float64  `yaml:"synthetic_amplitude"`
+	ReplayFile         string   `yaml:"replay_file"`
+	ReplayLoop         bool     `yaml:"replay_loop"`
+
+	// Live spectrum for subscribed clients; 0 uses the default
+	SpectrumRate    float64 `yaml:"spectrum_rate"`     // Updates per second (10)
+	SpectrumFFTSize int     `yaml:"spectrum_fft_size"` // Power of two, 256 to 65536 (4096)
+	SpectrumBands   int     `yaml:"spectrum_bands"`    // Log spaced bands from 20 Hz to 20 kHz (96)
 }
 
 func LoadConfig(path string) (*Config, error) {
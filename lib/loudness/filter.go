@@ -0,0 +1,136 @@
+package loudness
+
+import "math"
+
+// kWeighting is the K-weighting filter of BS.1770: a high shelf modelling
+// the head (+4 dB above about 1.5 kHz) followed by a high pass (RLB curve).
+// The coefficients are derived for any sample rate from the analog
+// prototype, giving the tabled values of the standard at 48 kHz.
+type kWeighting struct {
+	shelf, highPass biquad
+}
+
+func newKWeighting(sampleRate int) kWeighting {
+	fs := float64(sampleRate)
+
+	// High shelf
+	k := math.Tan(math.Pi * 1681.974450955533 / fs)
+	q := 0.7071752369554196
+	vh := math.Pow(10, 3.999843853973347/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	// High pass
+	k = math.Tan(math.Pi * 38.13547087602444 / fs)
+	q = 0.5003270373238773
+	a0 = 1 + k/q + k*k
+	highPass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+	return kWeighting{shelf, highPass}
+}
+
+func (f *kWeighting) process(x float64) float64 {
+	return f.highPass.process(f.shelf.process(x))
+}
+
+func (f *kWeighting) reset() {
+	f.shelf.z1, f.shelf.z2 = 0, 0
+	f.highPass.z1, f.highPass.z2 = 0, 0
+}
+
+// biquad is a second order IIR filter in transposed direct form II.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	z1, z2             float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.z1
+	f.z1 = f.b1*x - f.a1*y + f.z2
+	f.z2 = f.b2*x - f.a2*y
+	return y
+}
+
+// truePeakTaps is the length of each phase of the oversampling filter, as
+// in the example filter of BS.1770 Annex 2.
+const truePeakTaps = 12
+
+// truePeak finds the highest sample value between the samples: the audio
+// is oversampled by 4 below 96 kHz and by 2 below 192 kHz with a Blackman
+// windowed sinc interpolator, one filter phase per intermediate position.
+type truePeak struct {
+	channels int
+	phases   [][truePeakTaps]float64
+	hist     [][2 * truePeakTaps]float64 // Per channel, doubled to read a window without wrapping
+	pos      int
+	max      float64
+}
+
+func newTruePeak(channels, sampleRate int) *truePeak {
+	factor := 4
+	if sampleRate >= 192000 {
+		factor = 1
+	} else if sampleRate >= 96000 {
+		factor = 2
+	}
+	p := &truePeak{
+		channels: channels,
+		phases:   make([][truePeakTaps]float64, factor),
+		hist:     make([][2 * truePeakTaps]float64, channels),
+	}
+	// Phase i interpolates at i/factor samples after the center of the
+	// window (oldest sample first); phase 0 passes the sample through.
+	const width = truePeakTaps / 2
+	for i := range p.phases {
+		var sum float64
+		for j := range truePeakTaps {
+			t := float64(width-1-j) + float64(i)/float64(factor)
+			h := 1.0
+			if t != 0 {
+				h = math.Sin(math.Pi*t) / (math.Pi * t)
+			}
+			h *= 0.42 + 0.5*math.Cos(math.Pi*t/width) + 0.08*math.Cos(2*math.Pi*t/width)
+			p.phases[i][j] = h
+			sum += h
+		}
+		for j := range truePeakTaps {
+			p.phases[i][j] /= sum
+		}
+	}
+	return p
+}
+
+func (p *truePeak) add(frames []float32) {
+	for i := 0; i+p.channels <= len(frames); i += p.channels {
+		for c, s := range frames[i : i+p.channels] {
+			h := &p.hist[c]
+			h[p.pos], h[p.pos+truePeakTaps] = float64(s), float64(s)
+			window := h[p.pos+1 : p.pos+1+truePeakTaps]
+			for _, coefs := range p.phases {
+				var y float64
+				for j, v := range window {
+					y += coefs[j] * v
+				}
+				p.max = max(p.max, math.Abs(y))
+			}
+		}
+		p.pos = (p.pos + 1) % truePeakTaps
+	}
+}
+
+func (p *truePeak) reset() {
+	clear(p.hist)
+	p.pos, p.max = 0, 0
+}
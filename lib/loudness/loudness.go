@@ -0,0 +1,212 @@
+// Package loudness measures audio as specified by ITU-R BS.1770-4 and EBU
+// R128 (EBU Tech 3341 and 3342): momentary, short-term and integrated
+// loudness in LUFS, loudness range in LU and true peak in dBTP.
+//
+// All channels are weighted 1.0, like the front channels of the standard:
+// the inputs of an interface carry no speaker positions, so there is no
+// surround or LFE channel to tell apart.
+package loudness
+
+import (
+	"math"
+	"slices"
+)
+
+const (
+	absoluteGate = -70.0 // LUFS
+	relativeGate = -10.0 // LU below the loudness of the blocks above absoluteGate
+	rangeGate    = -20.0 // LU, relative gate of the loudness range
+
+	momentaryBlocks = 4  // 400 ms in 100 ms steps
+	shortTermBlocks = 30 // 3 s in 100 ms steps
+)
+
+// Meter measures the loudness of audio fed to it block by block. Loudness
+// is measured over 100 ms steps: momentary (400 ms) and short-term (3 s)
+// values are available once that much audio was added. It is not safe for
+// concurrent use.
+type Meter struct {
+	channels int
+	filters  []kWeighting
+	peak     *truePeak
+
+	step int     // Frames per 100 ms
+	fill int     // Frames of the current step
+	sum  float64 // Weighted sum of squares of the current step, all channels
+
+	recent [shortTermBlocks]float64 // Mean squares of the last steps, a ring
+	steps  int                      // Steps completed
+
+	blocks     []float64 // Mean square of each 400 ms gating block
+	shortTerms []float64 // Mean square of each 3 s window
+}
+
+// New returns a meter for interleaved audio with the given format.
+func New(channels, sampleRate int) *Meter {
+	m := &Meter{
+		channels: channels,
+		filters:  make([]kWeighting, channels),
+		peak:     newTruePeak(channels, sampleRate),
+		step:     max(sampleRate/10, 1),
+	}
+	for i := range m.filters {
+		m.filters[i] = newKWeighting(sampleRate)
+	}
+	return m
+}
+
+// NewWithoutTruePeak returns a meter that skips the true peak measurement
+// and its oversampling, for live meters that show loudness only. Its
+// TruePeak is NaN.
+func NewWithoutTruePeak(channels, sampleRate int) *Meter {
+	m := New(channels, sampleRate)
+	m.peak = nil
+	return m
+}
+
+// Reset starts a new measurement.
+func (m *Meter) Reset() {
+	for i := range m.filters {
+		m.filters[i].reset()
+	}
+	if m.peak != nil {
+		m.peak.reset()
+	}
+	m.fill, m.sum, m.steps = 0, 0, 0
+	m.blocks, m.shortTerms = m.blocks[:0], m.shortTerms[:0]
+}
+
+// Add measures interleaved frames.
+func (m *Meter) Add(frames []float32) {
+	if m.peak != nil {
+		m.peak.add(frames)
+	}
+	for i := 0; i+m.channels <= len(frames); i += m.channels {
+		for c, s := range frames[i : i+m.channels] {
+			y := m.filters[c].process(float64(s))
+			m.sum += y * y
+		}
+		if m.fill++; m.fill == m.step {
+			m.endStep()
+		}
+	}
+}
+
+// endStep completes a 100 ms step and the gating block and short-term
+// window ending with it.
+func (m *Meter) endStep() {
+	m.recent[m.steps%shortTermBlocks] = m.sum / float64(m.step)
+	m.steps++
+	m.fill, m.sum = 0, 0
+	if m.steps >= momentaryBlocks {
+		m.blocks = append(m.blocks, m.meanSquare(momentaryBlocks))
+	}
+	if m.steps >= shortTermBlocks {
+		m.shortTerms = append(m.shortTerms, m.meanSquare(shortTermBlocks))
+	}
+}
+
+// meanSquare returns the mean square of the last n steps.
+func (m *Meter) meanSquare(n int) float64 {
+	var sum float64
+	for i := range n {
+		sum += m.recent[(m.steps-1-i)%shortTermBlocks]
+	}
+	return sum / float64(n)
+}
+
+// Momentary returns the loudness of the last 400 ms, or -Inf before that
+// much audio was added.
+func (m *Meter) Momentary() float64 {
+	if m.steps < momentaryBlocks {
+		return math.Inf(-1)
+	}
+	return lufs(m.meanSquare(momentaryBlocks))
+}
+
+// ShortTerm returns the loudness of the last 3 s, or -Inf before that much
+// audio was added.
+func (m *Meter) ShortTerm() float64 {
+	if m.steps < shortTermBlocks {
+		return math.Inf(-1)
+	}
+	return lufs(m.meanSquare(shortTermBlocks))
+}
+
+// ShortTermMax returns the highest short-term loudness so far.
+func (m *Meter) ShortTermMax() float64 {
+	if len(m.shortTerms) == 0 {
+		return math.Inf(-1)
+	}
+	return lufs(slices.Max(m.shortTerms))
+}
+
+// Integrated returns the gated loudness of all audio added: the mean of the
+// 400 ms blocks above -70 LUFS and above 10 LU below the mean of those.
+// Silence returns -Inf.
+func (m *Meter) Integrated() float64 {
+	gated := gate(m.blocks, relativeGate)
+	if len(gated) == 0 {
+		return math.Inf(-1)
+	}
+	return lufs(mean(gated))
+}
+
+// Range returns the loudness range (LRA) in LU: the spread between the 10th
+// and the 95th percentile of the short-term loudness, gated like Integrated
+// but 20 LU below.
+func (m *Meter) Range() float64 {
+	gated := gate(m.shortTerms, rangeGate)
+	if len(gated) == 0 {
+		return 0
+	}
+	slices.Sort(gated)
+	at := func(p float64) float64 {
+		return lufs(gated[int(math.Round(p*float64(len(gated)-1)))])
+	}
+	return at(0.95) - at(0.10)
+}
+
+// TruePeak returns the highest absolute sample value of the audio
+// oversampled to at least 192 kHz, in dBTP.
+func (m *Meter) TruePeak() float64 {
+	if m.peak == nil {
+		return math.NaN()
+	}
+	return 20 * math.Log10(m.peak.max)
+}
+
+// gate returns the mean squares above the absolute gate and above relative
+// LU below the loudness of those.
+func gate(ms []float64, relative float64) []float64 {
+	abs := meanSquareOf(absoluteGate)
+	var above []float64
+	for _, v := range ms {
+		if v > abs {
+			above = append(above, v)
+		}
+	}
+	if len(above) == 0 {
+		return nil
+	}
+	rel := meanSquareOf(lufs(mean(above)) + relative)
+	return slices.DeleteFunc(above, func(v float64) bool { return v <= rel })
+}
+
+func mean(v []float64) float64 {
+	var sum float64
+	for _, x := range v {
+		sum += x
+	}
+	return sum / float64(len(v))
+}
+
+// lufs converts a weighted mean square to loudness.
+func lufs(ms float64) float64 {
+	return -0.691 + 10*math.Log10(ms)
+}
+
+// meanSquareOf converts loudness to a weighted mean square.
+func meanSquareOf(lufs float64) float64 {
+	return math.Pow(10, (lufs+0.691)/10)
+}
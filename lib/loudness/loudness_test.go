@@ -0,0 +1,106 @@
+package loudness
+
+import (
+	"math"
+	"testing"
+)
+
+const testRate = 48000
+
+// tone returns seconds of a stereo sine of hz at level dBFS, the same
+// signal in both channels, starting at phase.
+func tone(hz, level, seconds, phase float64) []float32 {
+	amp := math.Pow(10, level/20)
+	frames := int(seconds * testRate)
+	out := make([]float32, 2*frames)
+	for i := range frames {
+		s := float32(amp * math.Sin(2*math.Pi*hz*float64(i)/testRate+phase))
+		out[2*i], out[2*i+1] = s, s
+	}
+	return out
+}
+
+// measure feeds the segments to a new stereo meter in blocks of 10 ms,
+// like the recorder's buffers.
+func measure(segments ...[]float32) *Meter {
+	m := New(2, testRate)
+	for _, seg := range segments {
+		for len(seg) > 0 {
+			n := min(len(seg), 2*testRate/100)
+			m.Add(seg[:n])
+			seg = seg[n:]
+		}
+	}
+	return m
+}
+
+// EBU Tech 3341 test 1: a 1 kHz stereo sine at -23 dBFS reads -23 LUFS.
+func TestLoudnessOfReferenceTone(t *testing.T) {
+	m := measure(tone(1000, -23, 20, 0))
+	for _, v := range []struct {
+		name string
+		got  float64
+	}{
+		{"momentary", m.Momentary()},
+		{"short-term", m.ShortTerm()},
+		{"short-term max", m.ShortTermMax()},
+		{"integrated", m.Integrated()},
+	} {
+		if math.Abs(v.got+23) > 0.1 {
+			t.Errorf("%s loudness %.2f LUFS, want -23.0 ±0.1", v.name, v.got)
+		}
+	}
+	if lra := m.Range(); math.Abs(lra) > 0.1 {
+		t.Errorf("loudness range %.2f LU of a steady tone, want 0", lra)
+	}
+}
+
+// Gating: a tone at -36 dBFS next to one at -23 dBFS falls below the
+// relative gate and silence below the absolute one, so neither counts
+// towards the integrated loudness.
+func TestIntegratedLoudnessGating(t *testing.T) {
+	m := measure(tone(1000, -36, 10, 0), tone(1000, -23, 60, 0), tone(1000, -36, 10, 0), make([]float32, 2*10*testRate))
+	if got := m.Integrated(); math.Abs(got+23) > 0.1 {
+		t.Errorf("integrated loudness %.2f LUFS, want -23.0 ±0.1", got)
+	}
+	if got := measure(make([]float32, 2*5*testRate)).Integrated(); !math.IsInf(got, -1) {
+		t.Errorf("integrated loudness of silence %.2f LUFS, want -Inf", got)
+	}
+}
+
+// EBU Tech 3342 tests 1 to 4: loudness range of 1 kHz tones in steps.
+func TestLoudnessRange(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		levels []float64 // dBFS, 20 s each
+		want   float64   // LU
+	}{
+		{"-20/-30", []float64{-20, -30}, 10},
+		{"-20/-15", []float64{-20, -15}, 5},
+		{"-40/-20", []float64{-40, -20}, 20},
+		{"-50/-35/-20/-35/-50", []float64{-50, -35, -20, -35, -50}, 15},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var segments [][]float32
+			for _, level := range tc.levels {
+				segments = append(segments, tone(1000, level, 20, 0))
+			}
+			if got := measure(segments...).Range(); math.Abs(got-tc.want) > 1 {
+				t.Errorf("loudness range %.2f LU, want %.0f ±1", got, tc.want)
+			}
+		})
+	}
+}
+
+// EBU Tech 3341 true peak: a sine at a quarter of the sample rate whose
+// samples fall 45° off its peaks reads its true level, 3 dB above the
+// highest sample.
+func TestTruePeakBetweenSamples(t *testing.T) {
+	m := measure(tone(testRate/4, -6, 1, math.Pi/4))
+	if got := m.TruePeak(); got < -6.4 || got > -5.8 {
+		t.Errorf("true peak %.2f dBTP, want -6.0 +0.2/-0.4", got)
+	}
+	if got := NewWithoutTruePeak(2, testRate).TruePeak(); !math.IsNaN(got) {
+		t.Errorf("true peak %.2f without measurement, want NaN", got)
+	}
+}
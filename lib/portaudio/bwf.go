@@ -0,0 +1,98 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/types"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// bextFixedSize is the size of the fixed part of a version 2 bext chunk body;
+// the coding history follows it.
+const bextFixedSize = 602
+
+// NewBextInfo fills in the Broadcast Wave metadata for a take started at
+// `start`. The time reference points at the sample clock position of `start`
+// counted from midnight until the storage worker writes the first audio of
+// the take and replaces it with the time of that audio's first sample (see
+// StartStorageWorker).
+func NewBextInfo(description, originator, originatorReference string, start time.Time, sampleRate int) *types.BextInfo {
+	return &types.BextInfo{
+		Description:         description,
+		Originator:          originator,
+		OriginatorReference: originatorReference,
+		OriginationTime:     start,
+		TimeReference:       timeReference(start, sampleRate),
+	}
+}
+
+// timeReference returns the sample clock position of t, in samples since
+// the midnight before it.
+func timeReference(t time.Time, sampleRate int) uint64 {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return uint64(t.Sub(midnight).Seconds() * float64(sampleRate))
+}
+
+// bextChunk encodes the "bext" chunk, including its chunk header and a pad
+// byte if the body has an odd length.
+//
+// Bext Chunk Format (EBU Tech 3285 v2, Little Endian):
+//
+//	Offset  Size  Field                Description
+//	------  ----  -----                -----------
+//	0       256   Description          ASCII, NUL padded
+//	256     32    Originator           ASCII, NUL padded
+//	288     32    OriginatorReference  ASCII, NUL padded
+//	320     10    OriginationDate      "yyyy-mm-dd"
+//	330     8     OriginationTime      "hh:mm:ss"
+//	338     8     TimeReference        First sample, in samples since midnight (low, high uint32)
+//	346     2     Version              2
+//	348     64    UMID                 Unused (zero)
+//	412     10    Loudness fields      Unused (zero)
+//	422     180   Reserved             Zero
+//	602     ...   CodingHistory        ASCII, e.g. "A=PCM,F=48000,W=16,M=stereo,T=...\r\n"
+func bextChunk(format types.WavFormat) []byte {
+	b := format.Bext
+	history := fmt.Sprintf("A=PCM,F=%d,W=%d,M=%s,T=behringerRecorder\r\n", format.SampleRate, format.BitDepth, channelMode(format.Channels))
+	size := bextFixedSize + len(history)
+
+	buf := make([]byte, 8+size+size%2)
+	copy(buf[0:], "bext")
+	binary.LittleEndian.PutUint32(buf[4:], uint32(size))
+	body := buf[8:]
+	putASCII(body[0:256], b.Description)
+	putASCII(body[256:288], b.Originator)
+	putASCII(body[288:320], b.OriginatorReference)
+	copy(body[320:330], b.OriginationTime.Format("2006-01-02"))
+	copy(body[330:338], b.OriginationTime.Format("15:04:05"))
+	binary.LittleEndian.PutUint64(body[338:], b.TimeReference)
+	binary.LittleEndian.PutUint16(body[346:], 2)
+	copy(body[bextFixedSize:], history)
+	return buf
+}
+
+// channelMode is the coding history "M=" value for a channel count.
+func channelMode(channels int) string {
+	switch channels {
+	case 1:
+		return "mono"
+	case 2:
+		return "stereo"
+	}
+	return "multitrack"
+}
+
+// putASCII copies s into a fixed-size field, dropping non-ASCII characters
+// and truncating to fit. The rest of the field stays NUL.
+func putASCII(dst []byte, s string) {
+	i := 0
+	for _, r := range s {
+		if i == len(dst) {
+			return
+		}
+		if r >= 0x20 && r < 0x7F {
+			dst[i] = byte(r)
+			i++
+		}
+	}
+}
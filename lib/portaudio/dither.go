@@ -0,0 +1,94 @@
+package portaudio
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+)
+
+// Dither modes for the float to integer PCM conversion (config "dither").
+const (
+	DitherNone   = "none"   // round to nearest, no dither
+	DitherTPDF   = "tpdf"   // triangular (TPDF) dither of ±1 LSB
+	DitherShaped = "shaped" // TPDF dither with first-order noise shaping
+)
+
+// ParseDither validates a dither mode, "" meaning DitherNone.
+func ParseDither(s string) (string, error) {
+	switch s {
+	case "", DitherNone:
+		return DitherNone, nil
+	case DitherTPDF, DitherShaped:
+		return s, nil
+	}
+	return "", fmt.Errorf("unsupported dither %q (use none, tpdf or shaped)", s)
+}
+
+// quantizer converts float32 samples in [-1.0, 1.0] to signed integers of a
+// given bit depth. Samples are scaled by 2^(bits-1), so -1.0 maps to the most
+// negative code (-32768 at 16 bits) and +1.0 clips to the most positive one
+// (32767), and rounded to the nearest code instead of truncated toward zero,
+// which would add a DC offset and correlated distortion on quiet material.
+//
+// With TPDF dither two uniform random values are added before rounding,
+// which decorrelates the quantization error from the signal and turns it into
+// a constant noise floor:
+//
+//	d = u1 + u2 - 1          u1, u2 uniform in [0, 1), d in (-1, 1) LSB
+//	q = round(x*scale + d)
+//
+// Noise shaping feeds the previous quantization error of the channel back
+// into the next sample, which filters the error spectrum by (1 - z^-1): less
+// noise at low and mid frequencies, where hearing is most sensitive, more
+// towards Nyquist:
+//
+//	w    = x*scale - e[n-1]
+//	q    = round(w + d)
+//	e[n] = q - w
+//
+// The error state is kept per channel, so a quantizer must be used for one
+// take (one interleaved stream) at a time.
+type quantizer struct {
+	mode string
+	rng  *rand.Rand
+	err  []float64 // last quantization error per channel (noise shaping)
+}
+
+func newQuantizer(mode string) *quantizer {
+	return &quantizer{mode: mode, rng: rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))}
+}
+
+// reset clears the noise shaping state, e.g. at the start of a new take.
+func (q *quantizer) reset() {
+	q.err = q.err[:0]
+}
+
+// quantize converts sample s of channel ch to a `bits` wide integer.
+func (q *quantizer) quantize(s float32, ch, bits int) int32 {
+	scale := float64(int64(1) << (bits - 1))
+	v := float64(s) * scale
+
+	var r float64
+	switch q.mode {
+	case DitherTPDF:
+		r = math.Round(v + q.rng.Float64() + q.rng.Float64() - 1)
+	case DitherShaped:
+		for len(q.err) <= ch {
+			q.err = append(q.err, 0)
+		}
+		w := v - q.err[ch]
+		r = math.Round(w + q.rng.Float64() + q.rng.Float64() - 1)
+		// Bounded by the dither and rounding (< 1.5 LSB) even when the
+		// output clips, so the feedback loop stays stable.
+		q.err[ch] = r - w
+	default:
+		r = math.Round(v)
+	}
+
+	if r > scale-1 {
+		r = scale - 1
+	} else if r < -scale {
+		r = -scale
+	}
+	return int32(r)
+}
@@ -0,0 +1,146 @@
+package portaudio
+
+import (
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+const (
+	ditherTestSize = 4096
+	ditherTestBin  = 85 // Sine frequency in DFT bins, about 1 kHz at 48 kHz
+)
+
+// quantizationError quantizes a sine of amplitude lsb codes at 16 bits and
+// returns the input in codes and the error (output - input) per sample.
+func quantizationError(mode string, lsb float64) (in, errs []float64) {
+	q := newQuantizer(mode)
+	q.rng = rand.New(rand.NewPCG(1, 2))
+	in = make([]float64, ditherTestSize)
+	errs = make([]float64, ditherTestSize)
+	for i := range in {
+		s := float32(lsb / 32768 * math.Sin(2*math.Pi*ditherTestBin*float64(i)/ditherTestSize))
+		in[i] = float64(s) * 32768
+		errs[i] = float64(q.quantize(s, 0, 16)) - in[i]
+	}
+	return in, errs
+}
+
+// bandPower returns the mean power of DFT bins [lo, hi) of x.
+func bandPower(x []float64, lo, hi int) float64 {
+	var sum float64
+	for k := lo; k < hi; k++ {
+		var re, im float64
+		for i, v := range x {
+			angle := 2 * math.Pi * float64(k*i) / float64(len(x))
+			re += v * math.Cos(angle)
+			im -= v * math.Sin(angle)
+		}
+		sum += re*re + im*im
+	}
+	return sum / float64(hi-lo)
+}
+
+func correlation(a, b []float64) float64 {
+	var ab, aa, bb float64
+	for i := range a {
+		ab += a[i] * b[i]
+		aa += a[i] * a[i]
+		bb += b[i] * b[i]
+	}
+	return ab / math.Sqrt(aa*bb)
+}
+
+func TestQuantizerTPDFIsFlatAndUncorrelated(t *testing.T) {
+	in, errs := quantizationError(DitherTPDF, 3)
+
+	// Rounding (1/12) plus triangular dither (1/6) LSB²
+	var power float64
+	for _, e := range errs {
+		power += e * e
+	}
+	if power /= float64(len(errs)); power < 0.2 || power > 0.3 {
+		t.Errorf("error power %.3f LSB², want about 0.25", power)
+	}
+	if r := correlation(in, errs); math.Abs(r) > 0.05 {
+		t.Errorf("error correlates with the signal: r = %.3f", r)
+	}
+
+	quarter := ditherTestSize / 8
+	low := bandPower(errs, 1, quarter)
+	high := bandPower(errs, ditherTestSize/2-quarter, ditherTestSize/2)
+	if ratio := high / low; ratio < 0.7 || ratio > 1.4 {
+		t.Errorf("TPDF error spectrum not flat: high/low power ratio %.2f", ratio)
+	}
+}
+
+func TestQuantizerShapedMovesNoiseToNyquist(t *testing.T) {
+	_, tpdf := quantizationError(DitherTPDF, 3)
+	_, shaped := quantizationError(DitherShaped, 3)
+
+	quarter := ditherTestSize / 8
+	bands := func(errs []float64) (low, high float64) {
+		return bandPower(errs, 1, quarter), bandPower(errs, ditherTestSize/2-quarter, ditherTestSize/2)
+	}
+	tpdfLow, tpdfHigh := bands(tpdf)
+	shapedLow, shapedHigh := bands(shaped)
+	if shapedLow > tpdfLow/2 {
+		t.Errorf("shaped noise below %d bins: %.1f, TPDF %.1f; want less than half", quarter, shapedLow, tpdfLow)
+	}
+	if shapedHigh < tpdfHigh*2 {
+		t.Errorf("shaped noise near Nyquist: %.1f, TPDF %.1f; want more than twice", shapedHigh, tpdfHigh)
+	}
+}
+
+func TestQuantizerNoneRoundsToNearest(t *testing.T) {
+	_, errs := quantizationError(DitherNone, 3.3)
+	for i, e := range errs {
+		if math.Abs(e) > 0.5 {
+			t.Fatalf("sample %d: error %.3f LSB, want at most 0.5", i, e)
+		}
+	}
+
+	q := newQuantizer(DitherNone)
+	for _, tc := range []struct {
+		codes float64
+		want  int32
+	}{
+		{0.49, 0}, {0.51, 1}, {-0.49, 0}, {-0.51, -1},
+		{1000.4, 1000}, {1000.6, 1001}, {-1000.6, -1001},
+	} {
+		if got := q.quantize(float32(tc.codes/32768), 0, 16); got != tc.want {
+			t.Errorf("%v codes: got %d, want %d", tc.codes, got, tc.want)
+		}
+	}
+}
+
+func TestQuantizerClampsFullScale(t *testing.T) {
+	all := []string{DitherNone, DitherTPDF, DitherShaped}
+	for _, tc := range []struct {
+		bits  int
+		in    float32
+		want  int32
+		modes []string
+	}{
+		// Dither can lift -1.0 off the bottom code, and the shaping
+		// feedback can pull +1.0 below the top one
+		{16, -1.0, -32768, []string{DitherNone}},
+		{16, 1.0, 32767, []string{DitherNone, DitherTPDF}},
+		{24, -1.0, -8388608, []string{DitherNone}},
+		{24, 1.0, 8388607, []string{DitherNone, DitherTPDF}},
+		{16, -1.5, -32768, all},
+		{16, 1.5, 32767, all},
+		{24, -1.5, -8388608, all},
+		{24, 1.5, 8388607, all},
+	} {
+		for _, mode := range tc.modes {
+			q := newQuantizer(mode)
+			for range 100 {
+				if got := q.quantize(tc.in, 0, tc.bits); got != tc.want {
+					t.Errorf("%v at %d bits, dither %s: got %d, want %d", tc.in, tc.bits, mode, got, tc.want)
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/types"
+	"encoding/binary"
+	"math"
+)
+
+// encodeSamples converts float32 samples in [-1.0, 1.0] to the take's sample
+// format, as little-endian bytes:
+//
+//	16-bit:       q.quantize(s, ch, 16) -> int16, 2 bytes
+//	24-bit:       q.quantize(s, ch, 24) -> int24, 3 bytes (low, mid, high)
+//	32-bit float: IEEE 754 bits as is, 4 bytes
+//
+// Integer samples are rounded (and optionally dithered) by q, see quantizer.
+func encodeSamples(format types.WavFormat, samples []float32, q *quantizer) []byte {
+	size := format.SampleSize()
+	buf := make([]byte, len(samples)*size)
+	switch {
+	case format.Float:
+		for i, s := range samples {
+			binary.LittleEndian.PutUint32(buf[i*4:], math.Float32bits(s))
+		}
+	case format.BitDepth == 24:
+		for i, s := range samples {
+			v := q.quantize(s, i%format.Channels, 24)
+			buf[i*3] = byte(v)
+			buf[i*3+1] = byte(v >> 8)
+			buf[i*3+2] = byte(v >> 16)
+		}
+	default:
+		for i, s := range samples {
+			v := q.quantize(s, i%format.Channels, 16)
+			binary.LittleEndian.PutUint16(buf[i*2:], uint16(int16(v)))
+		}
+	}
+	return buf
+}
+
+// quantizeSamples converts float32 samples in [-1.0, 1.0] to integers of the
+// take's bit depth with q, for encoders (FLAC) that take integer samples.
+func quantizeSamples(format types.WavFormat, samples []float32, q *quantizer) []int32 {
+	out := make([]int32, len(samples))
+	for i, s := range samples {
+		out[i] = q.quantize(s, i%format.Channels, format.BitDepth)
+	}
+	return out
+}
@@ -4,13 +4,16 @@ import (
 	"behringerRecorder/lib/config"
 	"behringerRecorder/lib/types"
 	"fmt"
+	"io"
 	"log"
 	"time"
-
-	pa "github.com/gordonklaus/portaudio"
 )
 
-func StartAudioEngine(state *types.AppState, cfg *config.Config, deviceID int, recordChan chan<- []float32, playbackChan chan<- []float32) error {
+// StartAudioEngine starts the engine goroutine on device deviceID. Every
+// buffer it sends the recorded channels to recordChan and again to
+// meterChan (the consumers must not modify them), and the monitor pair to
+// playbackChan; a consumer that isn't ready misses the buffer.
+func StartAudioEngine(state *types.AppState, cfg *config.Config, deviceID int, recordChan, playbackChan, meterChan chan<- []float32) error {
 	state.Mu.Lock()
 	if state.QuitAudio != nil {
 		close(state.QuitAudio)
@@ -20,6 +23,7 @@ func StartAudioEngine(state *types.AppState, cfg *config.Config, deviceID int, r
 	quit := make(chan bool)
 	state.QuitAudio = quit
 	state.IsRunning = true
+	state.PublishParams()
 	state.Mu.Unlock()
 
 	devices := state.Devices
@@ -29,39 +33,63 @@ func StartAudioEngine(state *types.AppState, cfg *config.Config, deviceID int, r
 	}
 	dev := devices[deviceID]
 
+	src, err := NewAudioSource(cfg, dev)
+	if err != nil {
+		return err
+	}
+
 	// Engine GoRoutine
 	go func() {
 		log.Printf("[AUDIO] Started: %s", dev.Name)
 		defer log.Println("[AUDIO] Stopped")
 
-		// Input buffer provided to PortAudio. When the stream is opened we pass
-		// this slice to PortAudio. Each call to `stream.Read()` fills `in` with
-		// `FramesPerBuffer` frames of audio. Samples are float32 values in the
-		// range [-1.0, 1.0], laid out as interleaved channels per frame:
-		//   [frame0_ch0, frame0_ch1, ..., frame0_chN, frame1_ch0, frame1_ch1, ...]
-		// The total length is `cfg.BufferSize * dev.MaxInputChannels`.
-		//
-		// We later read specific input channel indexes (chL / chR) out of this
-		// interleaved buffer and copy them into a separate stereo buffer
-		// (`stereoChunk`) with layout [L,R,L,R,...] for consumers.
-		in := make([]float32, cfg.BufferSize*dev.MaxInputChannels)
-		stream, err := pa.OpenStream(pa.StreamParameters{
-			Input:      pa.StreamDeviceParameters{Device: dev, Channels: dev.MaxInputChannels, Latency: dev.DefaultLowInputLatency},
-			SampleRate: float64(cfg.SampleRate), FramesPerBuffer: cfg.BufferSize,
-		}, in)
-		if err != nil {
+		if err := src.Open(cfg.BufferSize); err != nil {
 			log.Println(err)
 			return
 		}
-		stream.Start()
-		defer stream.Stop()
-		defer stream.Close()
-
-		chL, chR := state.ChLeft, state.ChRight
-		boost := float32(state.Boost)
-		if boost == 0 {
-			boost = 1.0
+		defer src.Close()
+
+		// Input buffer filled by the source. Each call to `src.Read()` fills
+		// `in` with `cfg.BufferSize` frames of audio. Samples are float32
+		// values in the range [-1.0, 1.0], laid out as interleaved channels
+		// per frame:
+		//   [frame0_ch0, frame0_ch1, ..., frame0_chN, frame1_ch0, frame1_ch1, ...]
+		// The total length is `cfg.BufferSize * numCh`.
+		//
+		// We later read specific input channel indexes out of this
+		// interleaved buffer: the recorded channel set (`recChannels`) goes
+		// into `recChunk` with layout [ch0,ch1,...,chN,ch0,...] for the
+		// storage worker, and the monitor pair (chL / chR) goes into a
+		// separate stereo buffer (`stereoChunk`) with layout [L,R,L,R,...]
+		// for the browser.
+		numCh := src.Channels()
+		in := make([]float32, cfg.BufferSize*numCh)
+
+		// Routing and gains come from the published parameters, loaded
+		// again for every buffer so changes apply while the engine runs.
+		// Gains ramp to new values (see mixer); the limiter works after
+		// them on every input, and clips are counted after that.
+		params := state.Params.Load()
+		mix := newMixer(numCh, cfg.SampleRate, params)
+		clips := newClipCounter(numCh)
+		var lim *limiter
+		var gr *types.GainReduction
+		if cfg.Limiter {
+			release := time.Duration(cfg.LimiterReleaseMs * float64(time.Millisecond))
+			lim = newLimiter(numCh, cfg.SampleRate, cfg.LimiterCeiling, release)
+			gr = types.NewGainReduction(numCh)
+			log.Printf("[AUDIO] Limiter at %.1f dBFS", cfg.LimiterCeiling)
 		}
+		state.Mu.Lock()
+		state.GainReduction, state.Clips = gr, clips.total
+		state.Mu.Unlock()
+		defer func() {
+			state.Mu.Lock()
+			if state.Clips == clips.total {
+				state.GainReduction, state.Clips = nil, nil
+			}
+			state.Mu.Unlock()
+		}()
 
 		for {
 			select {
@@ -70,65 +98,112 @@ func StartAudioEngine(state *types.AppState, cfg *config.Config, deviceID int, r
 			default:
 			}
 
-			// `stream.Read()` blocks (or returns quickly depending on callback/RT
-			// behavior) and fills the `in` slice with the next `cfg.BufferSize`
-			// frames of audio, in the interleaved layout described above. An
+			// `src.Read()` blocks until the next `cfg.BufferSize` frames are
+			// available (hardware sources) or due (software sources). An
 			// error can indicate an underrun/overrun or device error; when it
-			// happens we skip this buffer and continue.
-			if err := stream.Read(); err != nil {
+			// happens we skip this buffer and continue. io.EOF means the
+			// source ran dry (e.g. a non-looping file replay).
+			if err := src.Read(in); err != nil {
+				if err == io.EOF {
+					log.Println("[AUDIO] Source exhausted")
+					state.Mu.Lock()
+					if state.QuitAudio == quit {
+						state.QuitAudio = nil
+						state.IsRunning = false
+					}
+					state.Mu.Unlock()
+					return
+				}
 				continue
 			}
 
+			if p := state.Params.Load(); p != params {
+				params = p
+				mix.update(p)
+			}
+			mix.trim(in)
+			if lim != nil {
+				lim.process(in, gr.Record)
+			}
+			clips.count(in)
+
+			recChannels := params.RecordChannels
 			stereoChunk := make([]float32, cfg.BufferSize*2)
+			recChunk := make([]float32, cfg.BufferSize*len(recChannels))
 			for i := 0; i < cfg.BufferSize; i++ {
-				// Compute index into the interleaved `in` buffer for this
-				// frame `i` and the chosen channel indexes `chL`/`chR`.
-				// Formula: index = (frameIndex * numChannels) + channelIndex
-				idxL := (i * dev.MaxInputChannels) + chL
-				idxR := (i * dev.MaxInputChannels) + chR
-
-				// Read samples if available (some devices may report fewer
-				// channels than MaxInputChannels; guard against out-of-range).
-				var sL, sR float32
-				if idxL < len(in) {
-					sL = in[idxL]
-				}
-				if idxR < len(in) {
-					sR = in[idxR]
-				}
+				// The frame `i` starts at this index into the interleaved
+				// `in` buffer; channel `c` of it is at frame + c.
+				frame := i * numCh
 
-				// Apply gain/boost, then clamp to the valid float sample range
-				// expected by downstream consumers ([-1.0, 1.0]). This keeps the
-				// audio safe for playback and prevents extreme values when
-				// serializing or writing to files.
-				sL *= boost
-				sR *= boost
-				if sL > 1.0 {
-					sL = 1.0
-				} else if sL < -1.0 {
-					sL = -1.0
+				stereoChunk[i*2], stereoChunk[i*2+1] = mix.monitor(in, frame)
+				for j, c := range recChannels {
+					recChunk[i*len(recChannels)+j] = clampSample(in, frame, c, numCh)
 				}
-				if sR > 1.0 {
-					sR = 1.0
-				} else if sR < -1.0 {
-					sR = -1.0
-				}
-
-				stereoChunk[i*2] = sL
-				stereoChunk[i*2+1] = sR
 			}
 
 			// Fan-out to consumers
 			select {
-			case recordChan <- stereoChunk:
+			case recordChan <- recChunk:
 			default:
 			}
 			select {
 			case playbackChan <- stereoChunk:
 			default:
 			}
+			select {
+			case meterChan <- recChunk:
+			default:
+			}
 		}
 	}()
 
 	return nil
 }
+
+// clampSample reads channel `ch` of the frame starting at `frame` in the
+// interleaved buffer `in` and clamps it to the valid float sample range
+// expected by downstream consumers ([-1.0, 1.0]). This keeps the audio safe
+// for playback and prevents extreme values when serializing or writing to
+// files; without the limiter, this clipping is all that keeps a boosted
+// overshoot in range. Channels the source doesn't have read as silence.
+func clampSample(in []float32, frame, ch, numCh int) float32 {
+	if ch < 0 || ch >= numCh || frame+ch >= len(in) {
+		return 0
+	}
+	s := in[frame+ch]
+	if s > 1.0 {
+		s = 1.0
+	} else if s < -1.0 {
+		s = -1.0
+	}
+	return s
+}
+
+// clipCounter counts the runs of samples at or beyond full scale per input
+// channel, the samples clampSample cuts.
+type clipCounter struct {
+	clipping []bool // Per input channel, its last sample was at full scale
+	total    *types.Clips
+}
+
+func newClipCounter(numCh int) *clipCounter {
+	return &clipCounter{clipping: make([]bool, numCh), total: types.NewClips(numCh)}
+}
+
+// count adds the runs in the interleaved buffer.
+func (c *clipCounter) count(in []float32) {
+	numCh := len(c.clipping)
+	for ch := range c.clipping {
+		var runs int64
+		for i := ch; i < len(in); i += numCh {
+			full := in[i] >= 1 || in[i] <= -1
+			if full && !c.clipping[ch] {
+				runs++
+			}
+			c.clipping[ch] = full
+		}
+		if runs > 0 {
+			c.total.Add(ch, runs)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/config"
+	"behringerRecorder/lib/types"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestEngineRecordsWav runs a take through the whole pipeline: synthetic
+// source, engine, storage worker and the WAV file on disk. The source is
+// paced in real time: the engine drops buffers its consumers don't take in
+// time, as it would with a sound card.
+func TestEngineRecordsWav(t *testing.T) {
+	cfg := &config.Config{
+		Source:             SourceSynthetic,
+		SyntheticSignals:   []string{"sine:1000", "sine:250"},
+		SyntheticAmplitude: 0.5,
+		SampleRate:         48000,
+		BufferSize:         480,
+	}
+	devices, err := VirtualDevices(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The take records the inputs swapped, and is open before the engine
+	// starts, so it holds the signal from its first sample
+	format := types.WavFormat{Channels: 2, SampleRate: cfg.SampleRate, BitDepth: 16}
+	channels := []int{1, 0}
+	file, _, _, err := CreateTake(filepath.Join(t.TempDir(), "rec"), 1, channels, false, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &types.AppState{
+		Devices:        devices,
+		ChLeft:         0,
+		ChRight:        1,
+		RecordChannels: channels,
+		TakeChannels:   channels,
+		IsRecording:    true,
+		File:           file,
+		FileFormat:     format,
+	}
+
+	recordChan := make(chan []float32, 64)
+	playbackChan := make(chan []float32, 64)
+	StartStorageWorker(state, cfg, recordChan, nil)
+	if err := StartAudioEngine(state, cfg, 0, recordChan, playbackChan, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A quarter of a second, then stop the take and the engine
+	const want = 12000
+	var frames int64
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		state.Mu.Lock()
+		if state.SamplesWrote >= want || time.Now().After(deadline) {
+			state.IsRecording = false
+			frames = state.SamplesWrote
+			FinalizeTake(state.File, nil, nil, format, frames, nil)
+			close(state.QuitAudio)
+			state.QuitAudio = nil
+			state.Mu.Unlock()
+			break
+		}
+		state.Mu.Unlock()
+	}
+	if frames < want {
+		t.Fatalf("%d frames written, want at least %d", frames, want)
+	}
+	if frames%int64(cfg.BufferSize) != 0 {
+		t.Errorf("%d frames written, not whole buffers of %d", frames, cfg.BufferSize)
+	}
+
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		t.Fatalf("not a RIFF WAVE file: %q", data[:12])
+	}
+	if size := binary.LittleEndian.Uint32(data[4:8]); int(size) != len(data)-8 {
+		t.Errorf("RIFF size %d, want %d", size, len(data)-8)
+	}
+	var audio []byte
+	for off := 12; off+8 <= len(data); {
+		id, size := string(data[off:off+4]), int(binary.LittleEndian.Uint32(data[off+4:off+8]))
+		if id == "data" {
+			if want := int(frames) * format.BlockAlign(); size != want {
+				t.Errorf("data size %d, want %d", size, want)
+			}
+			audio = data[off+8:]
+			break
+		}
+		off += 8 + size + size%2
+	}
+	if len(audio) != int(frames)*format.BlockAlign() {
+		t.Fatalf("%d bytes of audio, want %d", len(audio), int(frames)*format.BlockAlign())
+	}
+
+	// File channel 0 is input 1 (250 Hz), file channel 1 is input 0 (1 kHz)
+	freqs := []float64{250, 1000}
+	for i := range int(frames) {
+		for c, hz := range freqs {
+			got := int16(binary.LittleEndian.Uint16(audio[(i*2+c)*2:]))
+			want := 0.5 * math.Sin(2*math.Pi*hz*float64(i)/float64(cfg.SampleRate)) * 32768
+			if math.Abs(float64(got)-want) > 1 {
+				t.Fatalf("frame %d channel %d: %d, want %.1f", i, c, got, want)
+			}
+		}
+	}
+}
+
+func TestClipCounterCountsRunsPerInput(t *testing.T) {
+	c := newClipCounter(2)
+	// Channel 0: a run of three samples at or beyond full scale and one of
+	// a single sample; channel 1: one run across the two buffers
+	c.count([]float32{0.5, 0, 1, 0, -1, 0, 1.5, 0, 0.2, 1})
+	c.count([]float32{-1.2, -1, 0, 0.9, 0, 0})
+	for ch, want := range []int64{2, 1} {
+		if got, ok := c.total.Total(ch); !ok || got != want {
+			t.Errorf("channel %d: %d clips, want %d", ch, got, want)
+		}
+	}
+}
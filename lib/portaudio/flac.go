@@ -0,0 +1,637 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/types"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"os"
+)
+
+// flacBlockSize is the number of sample frames per FLAC frame. 4096 is the
+// libFLAC default for 44.1/48 kHz material.
+const flacBlockSize = 4096
+
+// flacMaxPartitionOrder limits the Rice partition search (2^8 partitions of
+// 16 residuals each at the block size above).
+const flacMaxPartitionOrder = 8
+
+// ParseFileFormat validates a recording file format: "" or "wav", or "flac".
+func ParseFileFormat(s string) (flac bool, err error) {
+	switch s {
+	case "", "wav":
+		return false, nil
+	case "flac":
+		return true, nil
+	}
+	return false, fmt.Errorf("unsupported file format %q (use wav or flac)", s)
+}
+
+// FlacEncoder writes a FLAC stream (RFC 9639) to a file, encoding each block
+// of flacBlockSize frames as it fills up:
+//
+//	Offset  Size  Field
+//	0       4     "fLaC"
+//	4       4     Metadata block header: last flag, type 0, length 34
+//	8       34    STREAMINFO: block sizes, frame sizes, sample rate,
+//	              channels, bits per sample, total samples, MD5
+//	42      ...   Frames
+//
+// Each channel of a frame is coded as a CONSTANT, VERBATIM or FIXED
+// (polynomial order 0-4, Rice coded residual) subframe, whichever is
+// smallest, and stereo frames pick the cheapest of left/right, left/side,
+// side/right and mid/side. STREAMINFO is rewritten by Sync and Close; until
+// Close the MD5 is left zero (unknown), since the stream isn't complete.
+type FlacEncoder struct {
+	f        *os.File
+	channels int
+	rate     int
+	bits     int
+
+	pending  []int32 // interleaved samples of the block being filled
+	frameNum uint64
+	samples  uint64 // sample frames encoded
+	minFrame int
+	maxFrame int
+	md5      hash.Hash
+	md5Buf   []byte
+}
+
+// NewFlacEncoder writes the FLAC header for format (16 or 24-bit integer
+// PCM, 1-8 channels) to f.
+func NewFlacEncoder(f *os.File, format types.WavFormat) (*FlacEncoder, error) {
+	if format.Float || (format.BitDepth != 16 && format.BitDepth != 24) {
+		return nil, fmt.Errorf("FLAC supports 16 and 24-bit recordings only")
+	}
+	if format.Channels < 1 || format.Channels > 8 {
+		return nil, fmt.Errorf("FLAC supports 1 to 8 channels")
+	}
+	e := &FlacEncoder{
+		f:        f,
+		channels: format.Channels,
+		rate:     format.SampleRate,
+		bits:     format.BitDepth,
+		pending:  make([]int32, 0, flacBlockSize*format.Channels),
+		md5:      md5.New(),
+	}
+	if _, err := f.Write(e.header(false)); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// NewFlacEncoders wraps the file(s) of a take in FLAC encoders: the single
+// interleaved file, or one mono encoder per track of a split-track take.
+func NewFlacEncoders(file *os.File, tracks []*os.File, format types.WavFormat) ([]types.Encoder, error) {
+	files := tracks
+	if file != nil {
+		files = []*os.File{file}
+	} else {
+		format.Channels = 1
+	}
+	encoders := make([]types.Encoder, 0, len(files))
+	for _, f := range files {
+		e, err := NewFlacEncoder(f, format)
+		if err != nil {
+			return nil, err
+		}
+		encoders = append(encoders, e)
+	}
+	return encoders, nil
+}
+
+// Write appends interleaved samples, encoding every completed block.
+func (e *FlacEncoder) Write(samples []int32) error {
+	for len(samples) > 0 {
+		n := min(cap(e.pending)-len(e.pending), len(samples))
+		e.pending = append(e.pending, samples[:n]...)
+		samples = samples[n:]
+		if len(e.pending) == cap(e.pending) {
+			if err := e.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Sync rewrites STREAMINFO with the frames encoded so far and syncs the file.
+func (e *FlacEncoder) Sync() error {
+	if _, err := e.f.WriteAt(e.header(false), 0); err != nil {
+		return err
+	}
+	return e.f.Sync()
+}
+
+// Close encodes the last (short) block, writes the final STREAMINFO including
+// the MD5 of the audio and closes the file.
+func (e *FlacEncoder) Close() error {
+	err := e.flush()
+	if _, werr := e.f.WriteAt(e.header(true), 0); err == nil {
+		err = werr
+	}
+	if cerr := e.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// header returns the stream marker and STREAMINFO block:
+//
+//	Bits  Field
+//	16    Minimum block size
+//	16    Maximum block size
+//	24    Minimum frame size in bytes (0 = unknown)
+//	24    Maximum frame size in bytes (0 = unknown)
+//	20    Sample rate
+//	3     Channels - 1
+//	5     Bits per sample - 1
+//	36    Total sample frames (0 = unknown)
+//	128   MD5 of the unencoded samples (0 = unknown)
+func (e *FlacEncoder) header(final bool) []byte {
+	var w bitWriter
+	w.buf = append(w.buf, "fLaC"...)
+	w.writeBits(1, 1) // last metadata block
+	w.writeBits(0, 7) // STREAMINFO
+	w.writeBits(34, 24)
+	w.writeBits(flacBlockSize, 16)
+	w.writeBits(flacBlockSize, 16)
+	w.writeBits(uint64(e.minFrame), 24)
+	w.writeBits(uint64(e.maxFrame), 24)
+	w.writeBits(uint64(e.rate), 20)
+	w.writeBits(uint64(e.channels-1), 3)
+	w.writeBits(uint64(e.bits-1), 5)
+	w.writeBits(e.samples>>32, 4)
+	w.writeBits(e.samples&0xFFFFFFFF, 32)
+	sum := make([]byte, 16)
+	if final {
+		sum = e.md5.Sum(nil)
+	}
+	return append(w.buf, sum...)
+}
+
+// flush encodes the pending samples as one frame.
+func (e *FlacEncoder) flush() error {
+	if len(e.pending) == 0 {
+		return nil
+	}
+	e.hashSamples(e.pending)
+	frame := e.encodeFrame(e.pending)
+	e.pending = e.pending[:0]
+	if _, err := e.f.Write(frame); err != nil {
+		return err
+	}
+	if e.minFrame == 0 || len(frame) < e.minFrame {
+		e.minFrame = len(frame)
+	}
+	if len(frame) > e.maxFrame {
+		e.maxFrame = len(frame)
+	}
+	return nil
+}
+
+// hashSamples adds samples to the MD5, as little-endian signed integers of
+// bits/8 bytes like the equivalent WAV data.
+func (e *FlacEncoder) hashSamples(samples []int32) {
+	size := e.bits / 8
+	if cap(e.md5Buf) < len(samples)*size {
+		e.md5Buf = make([]byte, len(samples)*size)
+	}
+	buf := e.md5Buf[:len(samples)*size]
+	for i, s := range samples {
+		if size == 2 {
+			binary.LittleEndian.PutUint16(buf[i*2:], uint16(s))
+		} else {
+			buf[i*3] = byte(s)
+			buf[i*3+1] = byte(s >> 8)
+			buf[i*3+2] = byte(s >> 16)
+		}
+	}
+	e.md5.Write(buf)
+}
+
+// encodeFrame encodes one block of interleaved samples:
+//
+//	Bits  Field
+//	14    Sync code 0b11111111111110
+//	1     Reserved (0)
+//	1     Blocking strategy (0 = fixed block size)
+//	4     Block size code
+//	4     Sample rate code
+//	4     Channel assignment
+//	3     Sample size code
+//	1     Reserved (0)
+//	8-48  Frame number, UTF-8 coded
+//	0/16  Block size - 1 (block size code 0b0111)
+//	0-16  Sample rate (sample rate codes 0b1100-0b1110)
+//	8     CRC-8 of the header
+//	...   One subframe per channel, then zero padding to a byte boundary
+//	16    CRC-16 of the frame
+func (e *FlacEncoder) encodeFrame(samples []int32) []byte {
+	n := len(samples) / e.channels
+	chans := make([][]int64, e.channels)
+	for c := range chans {
+		chans[c] = make([]int64, n)
+		for i := range n {
+			chans[c][i] = int64(samples[i*e.channels+c])
+		}
+	}
+
+	// Stereo decorrelation: side = L - R needs one extra bit,
+	// mid = (L + R) >> 1 (the dropped bit is recovered from side).
+	assignment := uint64(e.channels - 1)
+	subframes := make([]*bitWriter, e.channels)
+	if e.channels == 2 {
+		side := make([]int64, n)
+		mid := make([]int64, n)
+		for i := range n {
+			side[i] = chans[0][i] - chans[1][i]
+			mid[i] = (chans[0][i] + chans[1][i]) >> 1
+		}
+		l := encodeSubframe(chans[0], e.bits)
+		r := encodeSubframe(chans[1], e.bits)
+		s := encodeSubframe(side, e.bits+1)
+		m := encodeSubframe(mid, e.bits)
+		best := l.bits() + r.bits()
+		subframes[0], subframes[1] = l, r
+		if b := l.bits() + s.bits(); b < best {
+			best, assignment = b, 8
+			subframes[0], subframes[1] = l, s
+		}
+		if b := s.bits() + r.bits(); b < best {
+			best, assignment = b, 9
+			subframes[0], subframes[1] = s, r
+		}
+		if b := m.bits() + s.bits(); b < best {
+			assignment = 10
+			subframes[0], subframes[1] = m, s
+		}
+	} else {
+		for c := range chans {
+			subframes[c] = encodeSubframe(chans[c], e.bits)
+		}
+	}
+
+	var w bitWriter
+	w.writeBits(0x3FFE, 14)
+	w.writeBits(0, 1)
+	w.writeBits(0, 1)
+	blockCode := uint64(0b0111)
+	if n == flacBlockSize {
+		blockCode = 0b1100 // 256 * 2^(12-8)
+	}
+	w.writeBits(blockCode, 4)
+	rateCode, rateBits, rateValue := flacRateCode(e.rate)
+	w.writeBits(rateCode, 4)
+	w.writeBits(assignment, 4)
+	sizeCode := uint64(0b100) // 16 bits
+	if e.bits == 24 {
+		sizeCode = 0b110
+	}
+	w.writeBits(sizeCode, 3)
+	w.writeBits(0, 1)
+	w.buf = appendUTF8(w.buf, e.frameNum)
+	if blockCode == 0b0111 {
+		w.writeBits(uint64(n-1), 16)
+	}
+	if rateBits > 0 {
+		w.writeBits(rateValue, rateBits)
+	}
+	w.writeBits(uint64(crc8(w.buf)), 8)
+
+	for _, sf := range subframes {
+		w.append(sf)
+	}
+	w.align()
+	w.writeBits(uint64(crc16(w.buf)), 16)
+
+	e.frameNum++
+	e.samples += uint64(n)
+	return w.buf
+}
+
+// flacRateCode returns the frame header sample rate code and, for rates
+// without a code of their own, the value stored at the end of the header.
+func flacRateCode(rate int) (code uint64, bits uint, value uint64) {
+	switch rate {
+	case 88200:
+		return 1, 0, 0
+	case 176400:
+		return 2, 0, 0
+	case 192000:
+		return 3, 0, 0
+	case 8000:
+		return 4, 0, 0
+	case 16000:
+		return 5, 0, 0
+	case 22050:
+		return 6, 0, 0
+	case 24000:
+		return 7, 0, 0
+	case 32000:
+		return 8, 0, 0
+	case 44100:
+		return 9, 0, 0
+	case 48000:
+		return 10, 0, 0
+	case 96000:
+		return 11, 0, 0
+	}
+	switch {
+	case rate%1000 == 0 && rate/1000 <= 255:
+		return 12, 8, uint64(rate / 1000)
+	case rate <= 65535:
+		return 13, 16, uint64(rate)
+	case rate%10 == 0 && rate/10 <= 65535:
+		return 14, 16, uint64(rate / 10)
+	}
+	return 0, 0, 0 // taken from STREAMINFO
+}
+
+// encodeSubframe returns the smallest encoding of one channel of a block,
+// with sample size bits:
+//
+//	Bits  Field
+//	1     Zero padding
+//	6     Type: 000000 CONSTANT, 000001 VERBATIM, 001xxx FIXED order xxx
+//	1     Wasted bits flag (0)
+//	...   CONSTANT: one sample; VERBATIM: all samples;
+//	      FIXED: order warm-up samples, then the Rice coded residual
+func encodeSubframe(x []int64, bits int) *bitWriter {
+	constant := true
+	for _, v := range x[1:] {
+		if v != x[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		w := &bitWriter{}
+		w.writeBits(0, 8)
+		w.writeSigned(x[0], uint(bits))
+		return w
+	}
+
+	// FIXED predictors of order 0-4 are the successive differences of the
+	// signal; pick the order with the smallest residual.
+	var best *bitWriter
+	residual := append([]int64(nil), x...)
+	for order := 0; order <= 4 && order < len(x); order++ {
+		if order > 0 {
+			// Difference in place, from the end so earlier values are
+			// still the previous order's residual.
+			for i := len(x) - 1; i >= order; i-- {
+				residual[i] -= residual[i-1]
+			}
+		}
+		w := &bitWriter{}
+		w.writeBits(uint64(0b00010000|order<<1), 8)
+		for _, v := range x[:order] {
+			w.writeSigned(v, uint(bits))
+		}
+		writeResidual(w, residual[order:], len(x), order)
+		if best == nil || w.bits() < best.bits() {
+			best = w
+		}
+	}
+
+	verbatimBits := 8 + len(x)*bits
+	if best.bits() >= verbatimBits {
+		w := &bitWriter{}
+		w.writeBits(0b00000010, 8)
+		for _, v := range x {
+			w.writeSigned(v, uint(bits))
+		}
+		return w
+	}
+	return best
+}
+
+// writeResidual Rice codes the residual of a FIXED subframe of a block of
+// blockSize samples, choosing the partition order and per-partition Rice
+// parameters that give the fewest bits:
+//
+//	Bits  Field
+//	2     Coding method: 00 = 4-bit parameters, 01 = 5-bit parameters
+//	4     Partition order p (2^p partitions)
+//	...   Per partition: parameter k, then each residual as
+//	      zigzag(r) >> k in unary (zeros ended by a one), then its low k bits
+//
+// The first partition holds (blockSize >> p) - order residuals, the others
+// blockSize >> p.
+func writeResidual(w *bitWriter, residual []int64, blockSize, order int) {
+	u := make([]uint64, len(residual))
+	for i, r := range residual {
+		u[i] = uint64(r<<1) ^ uint64(r>>63)
+	}
+
+	// Sums of the zigzag values per partition at the highest usable
+	// order; lower orders merge neighbouring pairs.
+	maxOrder := 0
+	for p := 1; p <= flacMaxPartitionOrder; p++ {
+		if blockSize%(1<<p) != 0 || blockSize>>p <= order {
+			break
+		}
+		maxOrder = p
+	}
+	sums := make([]uint64, 1<<maxOrder)
+	counts := make([]int, 1<<maxOrder)
+	i := 0
+	for p := range sums {
+		n := blockSize >> maxOrder
+		if p == 0 {
+			n -= order
+		}
+		for _, v := range u[i : i+n] {
+			sums[p] += v
+		}
+		counts[p] = n
+		i += n
+	}
+
+	bestBits := -1
+	var bestParams []int
+	bestOrder := 0
+	for p := maxOrder; p >= 0; p-- {
+		total := 0
+		params := make([]int, len(sums))
+		for j := range sums {
+			k, bits := riceParam(sums[j], counts[j])
+			params[j] = k
+			total += bits
+		}
+		paramBits := 4
+		for _, k := range params {
+			if k >= 15 {
+				paramBits = 5
+			}
+		}
+		total += len(params) * paramBits
+		if bestBits < 0 || total < bestBits {
+			bestBits, bestParams, bestOrder = total, params, p
+		}
+		if p > 0 {
+			half := len(sums) / 2
+			for j := range half {
+				sums[j] = sums[2*j] + sums[2*j+1]
+				counts[j] = counts[2*j] + counts[2*j+1]
+			}
+			sums, counts = sums[:half], counts[:half]
+		}
+	}
+
+	paramBits := uint(4)
+	for _, k := range bestParams {
+		if k >= 15 {
+			paramBits = 5
+		}
+	}
+	w.writeBits(uint64(paramBits-4), 2)
+	w.writeBits(uint64(bestOrder), 4)
+	i = 0
+	for p, k := range bestParams {
+		n := blockSize >> bestOrder
+		if p == 0 {
+			n -= order
+		}
+		w.writeBits(uint64(k), paramBits)
+		for _, v := range u[i : i+n] {
+			w.writeUnary(v >> k)
+			w.writeBits(v, uint(k))
+		}
+		i += n
+	}
+}
+
+// riceParam returns the Rice parameter k for a partition of n zigzag values
+// summing to sum, and the estimated size in bits: each value takes k+1 bits
+// plus its quotient, sum>>k in total. Parameters stay below 31, the escape
+// code of the 5-bit method.
+func riceParam(sum uint64, n int) (k int, bits int) {
+	bestK, best := 0, -1
+	for k := 0; k < 31; k++ {
+		b := n*(k+1) + int(sum>>k)
+		if best < 0 || b < best {
+			bestK, best = k, b
+		}
+		if sum>>k == 0 {
+			break
+		}
+	}
+	return bestK, best
+}
+
+// appendUTF8 appends v in the UTF-8 style coding FLAC uses for frame
+// numbers (up to 36 bits, 1-7 bytes).
+func appendUTF8(buf []byte, v uint64) []byte {
+	if v < 0x80 {
+		return append(buf, byte(v))
+	}
+	n := 2 // total bytes
+	for v >= 1<<(5*n+1) {
+		n++
+	}
+	first := byte(0xFF<<(8-n)) | byte(v>>(6*(n-1)))
+	buf = append(buf, first)
+	for i := n - 2; i >= 0; i-- {
+		buf = append(buf, 0x80|byte(v>>(6*i))&0x3F)
+	}
+	return buf
+}
+
+// crc8 is the FLAC frame header CRC (polynomial x^8 + x^2 + x + 1, init 0).
+func crc8(data []byte) uint8 {
+	var crc uint8
+	for _, b := range data {
+		crc ^= b
+		for range 8 {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// crc16 is the FLAC frame CRC (polynomial x^16 + x^15 + x^2 + 1, init 0).
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// bitWriter packs big-endian bit fields into bytes, MSB first.
+type bitWriter struct {
+	buf   []byte
+	cache uint64 // pending bits, the low n of which are valid
+	n     uint
+}
+
+// writeBits writes the low `bits` bits of v (at most 32 at a time).
+func (w *bitWriter) writeBits(v uint64, bits uint) {
+	for bits > 32 {
+		bits -= 32
+		w.writeBits(v>>bits, 32)
+	}
+	if bits == 0 {
+		return
+	}
+	w.cache = w.cache<<bits | v&(1<<bits-1)
+	w.n += bits
+	for w.n >= 8 {
+		w.n -= 8
+		w.buf = append(w.buf, byte(w.cache>>w.n))
+	}
+}
+
+// writeSigned writes v as a two's complement number of `bits` bits.
+func (w *bitWriter) writeSigned(v int64, bits uint) {
+	w.writeBits(uint64(v), bits)
+}
+
+// writeUnary writes q zero bits followed by a one.
+func (w *bitWriter) writeUnary(q uint64) {
+	for q >= 32 {
+		w.writeBits(0, 32)
+		q -= 32
+	}
+	w.writeBits(1, uint(q)+1)
+}
+
+// align pads with zero bits to the next byte boundary.
+func (w *bitWriter) align() {
+	if w.n > 0 {
+		w.writeBits(0, 8-w.n)
+	}
+}
+
+// bits returns the number of bits written.
+func (w *bitWriter) bits() int {
+	return len(w.buf)*8 + int(w.n)
+}
+
+// append copies all bits written to o.
+func (w *bitWriter) append(o *bitWriter) {
+	if w.n == 0 {
+		w.buf = append(w.buf, o.buf...)
+	} else {
+		for _, b := range o.buf {
+			w.writeBits(uint64(b), 8)
+		}
+	}
+	if o.n > 0 {
+		w.writeBits(o.cache, o.n)
+	}
+}
@@ -0,0 +1,183 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/audiofile"
+	"behringerRecorder/lib/types"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// flacTestSignal returns frames of interleaved samples at the given bit
+// depth that exercise every subframe type: tones with a little noise (LPC
+// and fixed prediction), silence (constant), white noise at full scale
+// (verbatim) and the extreme sample values.
+func flacTestSignal(channels, bits, frames int) []int32 {
+	rng := rand.New(rand.NewPCG(3, 4))
+	top := int32(1)<<(bits-1) - 1
+	samples := make([]int32, frames*channels)
+	for i := range frames {
+		for c := range channels {
+			var v int32
+			switch {
+			case i < flacBlockSize:
+				hz := 220 * float64(c+1)
+				v = int32(0.5*float64(top)*math.Sin(2*math.Pi*hz*float64(i)/48000)) + rng.Int32N(16) - 8
+			case i < 2*flacBlockSize:
+				// Silence on even channels, a slow ramp on odd ones
+				if c%2 == 1 {
+					v = int32(i - flacBlockSize)
+				}
+			case i < 3*flacBlockSize:
+				v = rng.Int32N(2*top+2) - top - 1
+			default:
+				v = []int32{top, -top - 1, 0, 1}[(i+c)%4]
+			}
+			samples[i*channels+c] = v
+		}
+	}
+	return samples
+}
+
+// readFlacTest decodes the file at path with package audiofile and returns
+// its header info, the integer samples it decoded and the error that ended
+// decoding, nil at the end of the audio.
+func readFlacTest(t *testing.T, path string) (audiofile.Info, []int32, error) {
+	t.Helper()
+	r, err := audiofile.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	info := r.Info()
+	scale := float64(uint64(1) << (info.BitDepth - 1))
+	var samples []int32
+	buf := make([]float32, 1000*info.Channels)
+	for {
+		n, err := r.Read(buf)
+		for _, s := range buf[:n*info.Channels] {
+			samples = append(samples, int32(math.Round(float64(s)*scale)))
+		}
+		if err == io.EOF {
+			return info, samples, nil
+		}
+		if err != nil {
+			return info, samples, err
+		}
+	}
+}
+
+// firstMismatch returns the index of the first sample that differs, or -1.
+func firstMismatch(got, want []int32) int {
+	for i := range min(len(got), len(want)) {
+		if got[i] != want[i] {
+			return i
+		}
+	}
+	if len(got) != len(want) {
+		return min(len(got), len(want))
+	}
+	return -1
+}
+
+func TestFlacRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		bits, channels int
+	}{
+		{"16-bit mono", 16, 1},
+		{"16-bit stereo", 16, 2},
+		{"24-bit mono", 24, 1},
+		{"24-bit 6 channels", 24, 6},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Four full blocks and a partial one
+			frames := 4*flacBlockSize + 1234
+			want := flacTestSignal(tc.channels, tc.bits, frames)
+			format := types.WavFormat{Channels: tc.channels, SampleRate: 48000, BitDepth: tc.bits, Flac: true}
+			path := filepath.Join(t.TempDir(), "rec.flac")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e, err := NewFlacEncoder(f, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// In chunks that don't line up with the blocks, like the
+			// storage worker's
+			for rest := want; len(rest) > 0; {
+				n := min(len(rest), 1000*tc.channels)
+				if err := e.Write(rest[:n]); err != nil {
+					t.Fatal(err)
+				}
+				rest = rest[n:]
+			}
+			if err := e.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			info, got, err := readFlacTest(t, path)
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			if info.Channels != tc.channels || info.BitDepth != tc.bits || info.SampleRate != 48000 || info.Frames != int64(frames) {
+				t.Errorf("header says %+v", info)
+			}
+			if i := firstMismatch(got, want); i >= 0 {
+				t.Fatalf("sample %d (frame %d) differs, %d samples decoded, want %d", i, i/tc.channels, len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestFlacSyncSurvivesTruncation(t *testing.T) {
+	format := types.WavFormat{Channels: 2, SampleRate: 48000, BitDepth: 24, Flac: true}
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "rec.flac"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	e, err := NewFlacEncoder(f, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two and a half blocks: the half block is still pending at the crash
+	want := flacTestSignal(2, 24, 2*flacBlockSize+flacBlockSize/2)
+	if err := e.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	synced := filepath.Join(dir, "synced.flac")
+	os.WriteFile(synced, data, 0644)
+	info, got, err := readFlacTest(t, synced)
+	if err != nil {
+		t.Fatalf("decoding the synced file: %v", err)
+	}
+	if info.Frames != 2*flacBlockSize {
+		t.Errorf("header says %d frames after Sync, want %d", info.Frames, 2*flacBlockSize)
+	}
+	if i := firstMismatch(got, want[:2*flacBlockSize*2]); i >= 0 {
+		t.Fatalf("synced file: sample %d differs, %d samples decoded", i, len(got))
+	}
+
+	// Cut in the middle of the second frame: the first one still decodes
+	cut := filepath.Join(dir, "cut.flac")
+	os.WriteFile(cut, data[:len(data)-100], 0644)
+	_, got, _ = readFlacTest(t, cut)
+	if i := firstMismatch(got, want[:flacBlockSize*2]); i >= 0 {
+		t.Fatalf("cut file: sample %d differs, %d samples decoded, want the %d of the first frame", i, len(got), flacBlockSize*2)
+	}
+}
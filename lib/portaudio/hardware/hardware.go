@@ -0,0 +1,99 @@
+// Package hardware is the PortAudio audio source backend: it captures from
+// the sound cards PortAudio finds. It needs cgo and libportaudio, so it is
+// kept out of package portaudio and registers itself there when imported;
+// the software sources and their tests build without it.
+package hardware
+
+import (
+	"behringerRecorder/lib/portaudio"
+	"behringerRecorder/lib/types"
+	"fmt"
+
+	pa "github.com/gordonklaus/portaudio"
+)
+
+func init() {
+	portaudio.RegisterHardware(func(dev types.Device, sampleRate int) (portaudio.AudioSource, error) {
+		return &Source{Device: dev, Rate: sampleRate}, nil
+	})
+}
+
+// Devices lists the PortAudio devices, by their PortAudio index. PortAudio
+// must be initialized.
+func Devices() ([]types.Device, error) {
+	infos, err := pa.Devices()
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]types.Device, len(infos))
+	for i, d := range infos {
+		devices[i] = types.Device{
+			Name:    d.Name,
+			Inputs:  d.MaxInputChannels,
+			Backend: portaudio.SourcePortAudio,
+			Index:   i,
+		}
+	}
+	return devices, nil
+}
+
+// Source captures from a PortAudio input device, opening all of its input
+// channels.
+type Source struct {
+	Device types.Device
+	Rate   int
+
+	stream *pa.Stream
+	in     []float32
+}
+
+func (s *Source) Open(framesPerBuffer int) error {
+	infos, err := pa.Devices()
+	if err != nil {
+		return err
+	}
+	i := s.Device.Index
+	if i < 0 || i >= len(infos) || infos[i].Name != s.Device.Name {
+		return fmt.Errorf("PortAudio device %q not found", s.Device.Name)
+	}
+	info := infos[i]
+	// The buffer handed to PortAudio; each stream.Read() overwrites it with
+	// the next `framesPerBuffer` interleaved frames.
+	s.in = make([]float32, framesPerBuffer*info.MaxInputChannels)
+	stream, err := pa.OpenStream(pa.StreamParameters{
+		Input:      pa.StreamDeviceParameters{Device: info, Channels: info.MaxInputChannels, Latency: info.DefaultLowInputLatency},
+		SampleRate: float64(s.Rate), FramesPerBuffer: framesPerBuffer,
+	}, s.in)
+	if err != nil {
+		return err
+	}
+	if err := stream.Start(); err != nil {
+		stream.Close()
+		return err
+	}
+	s.stream = stream
+	return nil
+}
+
+func (s *Source) Read(buf []float32) error {
+	// `stream.Read()` blocks until the next buffer is available. An error
+	// can indicate an underrun/overrun or device error.
+	if err := s.stream.Read(); err != nil {
+		return err
+	}
+	copy(buf, s.in)
+	return nil
+}
+
+func (s *Source) Close() error {
+	if s.stream == nil {
+		return nil
+	}
+	s.stream.Stop()
+	err := s.stream.Close()
+	s.stream = nil
+	return err
+}
+
+func (s *Source) Channels() int   { return s.Device.Inputs }
+func (s *Source) SampleRate() int { return s.Rate }
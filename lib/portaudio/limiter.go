@@ -0,0 +1,146 @@
+package portaudio
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// limiterLookahead is the delay the limiter adds to the audio: the time
+	// it has to turn the gain down before a peak arrives.
+	limiterLookahead = 2 * time.Millisecond
+	// defaultLimiterRelease is used for limiter_release_ms 0.
+	defaultLimiterRelease = 50 * time.Millisecond
+)
+
+// limiter is a look-ahead brickwall limiter: no sample leaves it above the
+// ceiling, but instead of clipping the peak it turns the gain down smoothly
+// over the look-ahead time before it and back up over the release time
+// after it. Each input channel is limited on its own, so one hot input
+// doesn't duck the others, and all of them are, so the routing can change
+// while it runs.
+//
+// Per channel and sample, with L the look-ahead in samples:
+//
+//	need[n] = min(1, ceiling / |x[n]|)          gain that keeps x[n] in
+//	hold[n] = min(need[n-L .. n])               known L samples ahead
+//	env[n]  = hold[n] if below env[n-1], else release towards it
+//	y[n]    = x[n-L] * mean(env[n-L+1 .. n])
+//
+// The mean fades the gain in over L samples and still reaches need at the
+// delayed peak, since every env it averages is at most that.
+type limiter struct {
+	channels []*limiterChannel // Per input channel
+	ceiling  float64           // Linear
+	release  float64           // Per-sample step of the release
+	size     int               // Look-ahead L in samples
+}
+
+// limiterChannel is the state of one limited channel.
+type limiterChannel struct {
+	delay []float32 // The last L input samples, a ring
+	env   []float64 // The last L envelope values, a ring
+	sum   float64   // Sum of env
+	pos   int       // Ring position of the oldest entries
+	last  float64   // env[n-1]
+	n     int       // Samples processed
+
+	// Monotonic queue of the need values in the hold window: increasing
+	// values, each with the sample number it expires after
+	queue []limiterNeed
+	head  int
+	count int
+}
+
+type limiterNeed struct {
+	gain float64
+	n    int
+}
+
+// newLimiter limits numCh channels to ceilingDB dBFS.
+func newLimiter(numCh, sampleRate int, ceilingDB float64, release time.Duration) *limiter {
+	if release <= 0 {
+		release = defaultLimiterRelease
+	}
+	l := &limiter{
+		channels: make([]*limiterChannel, numCh),
+		ceiling:  math.Pow(10, ceilingDB/20),
+		release:  1 - math.Exp(-1/(release.Seconds()*float64(sampleRate))),
+		size:     max(int(limiterLookahead.Seconds()*float64(sampleRate)), 1),
+	}
+	for c := range l.channels {
+		lc := &limiterChannel{
+			delay: make([]float32, l.size),
+			env:   make([]float64, l.size),
+			sum:   float64(l.size),
+			last:  1,
+			queue: make([]limiterNeed, l.size+1),
+		}
+		for i := range lc.env {
+			lc.env[i] = 1
+		}
+		l.channels[c] = lc
+	}
+	return l
+}
+
+// process limits the interleaved buffer in place. It calls reduction with
+// the deepest gain reduction of each channel in dB (0 for none).
+func (l *limiter) process(in []float32, reduction func(ch int, db float64)) {
+	numCh := len(l.channels)
+	for c, lc := range l.channels {
+		least := 1.0
+		for i := c; i < len(in); i += numCh {
+			var gain float64
+			in[i], gain = lc.next(in[i], l)
+			least = min(least, gain)
+		}
+		if reduction != nil {
+			reduction(c, max(-20*math.Log10(least), 0))
+		}
+	}
+}
+
+// next takes one input sample and returns the limited output sample from L
+// samples ago with the gain applied to it.
+func (lc *limiterChannel) next(x float32, l *limiter) (float32, float64) {
+	need := 1.0
+	if abs := math.Abs(float64(x)); abs > l.ceiling {
+		need = l.ceiling / abs
+	}
+
+	// Sliding minimum over the last L+1 needs
+	for lc.count > 0 && lc.queue[lc.head].n < lc.n {
+		lc.head = (lc.head + 1) % len(lc.queue)
+		lc.count--
+	}
+	for lc.count > 0 && lc.queue[(lc.head+lc.count-1)%len(lc.queue)].gain >= need {
+		lc.count--
+	}
+	lc.queue[(lc.head+lc.count)%len(lc.queue)] = limiterNeed{need, lc.n + l.size}
+	lc.count++
+	hold := lc.queue[lc.head].gain
+	lc.n++
+
+	env := hold
+	if hold > lc.last {
+		env = lc.last + (hold-lc.last)*l.release
+	}
+	lc.last = env
+
+	// Ring step: drop the oldest sample and envelope, add the new ones
+	out := lc.delay[lc.pos]
+	lc.delay[lc.pos] = x
+	lc.sum += env - lc.env[lc.pos]
+	lc.env[lc.pos] = env
+	if lc.pos++; lc.pos == l.size {
+		// Sum afresh once per round so rounding errors don't pile up
+		lc.pos, lc.sum = 0, 0
+		for _, e := range lc.env {
+			lc.sum += e
+		}
+	}
+
+	gain := min(lc.sum/float64(l.size), 1)
+	return out * float32(gain), gain
+}
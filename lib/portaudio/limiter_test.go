@@ -0,0 +1,99 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/types"
+	"math"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+// limitBuffers runs in through l in buffers of 480 frames, the way the
+// engine does, and returns the output.
+func limitBuffers(l *limiter, in []float32, reduction func(ch int, db float64)) []float32 {
+	out := append([]float32(nil), in...)
+	step := 480 * len(l.channels)
+	for i := 0; i < len(out); i += step {
+		l.process(out[i:min(i+step, len(out))], reduction)
+	}
+	return out
+}
+
+func TestLimiterKeepsCeiling(t *testing.T) {
+	const ceilingDB = -1.0
+	ceiling := float32(math.Pow(10, ceilingDB/20))
+	l := newLimiter(2, 48000, ceilingDB, 20*time.Millisecond)
+	delay := l.size * 2
+
+	// Noise with bursts and single spikes up to 12 dB over full scale
+	rng := rand.New(rand.NewPCG(1, 2))
+	in := make([]float32, 2*48000)
+	for i := range in {
+		amp := 0.3
+		switch {
+		case i%9600 < 960:
+			amp = 4
+		case i%4001 == 0:
+			amp = 2.5
+		}
+		in[i] = float32(amp * (2*rng.Float64() - 1))
+	}
+	out := limitBuffers(l, in, nil)
+
+	for i, y := range out {
+		if math.Abs(float64(y)) > float64(ceiling)*(1+1e-6) {
+			t.Fatalf("sample %d (channel %d) is %.4f, above the ceiling %.4f", i, i%2, y, ceiling)
+		}
+		// The output is the input from L samples ago, turned down
+		var x float32
+		if i >= delay {
+			x = in[i-delay]
+		}
+		if y*x < 0 || math.Abs(float64(y)) > math.Abs(float64(x))+1e-6 {
+			t.Fatalf("sample %d is %.4f, not a gain of at most 1 on the delayed input %.4f", i, y, x)
+		}
+	}
+}
+
+func TestLimiterPassesQuietAudio(t *testing.T) {
+	l := newLimiter(1, 48000, -1, 0)
+	in := make([]float32, 4800)
+	for i := range in {
+		in[i] = float32(0.5 * math.Sin(2*math.Pi*1000*float64(i)/48000))
+	}
+	out := limitBuffers(l, in, func(ch int, db float64) {
+		if db != 0 {
+			t.Fatalf("gain reduction of %.2f dB on channel %d below the ceiling", db, ch)
+		}
+	})
+	for i := l.size; i < len(out); i++ {
+		if out[i] != in[i-l.size] {
+			t.Fatalf("sample %d is %v, want the input %v from the look-ahead before", i, out[i], in[i-l.size])
+		}
+	}
+}
+
+func TestLimiterReportsGainReductionPerChannel(t *testing.T) {
+	// Channel 1 is 6 dB over the ceiling, channels 0 and 2 are below it
+	l := newLimiter(3, 48000, -12, 0)
+	gr := types.NewGainReduction(3)
+	in := make([]float32, 3*4800)
+	for i := range 4800 {
+		s := math.Sin(2 * math.Pi * 1000 * float64(i) / 48000)
+		in[3*i] = float32(0.2 * s)
+		in[3*i+1] = float32(0.5 * s)
+		in[3*i+2] = float32(-0.1 * s)
+	}
+	limitBuffers(l, in, gr.Record)
+
+	for ch, want := range []float64{0, 20 * math.Log10(0.5/math.Pow(10, -12.0/20)), 0} {
+		got, ok := gr.Take(ch)
+		if !ok || math.Abs(got-want) > 0.1 {
+			t.Errorf("channel %d: gain reduction %.2f dB, want %.2f", ch, got, want)
+		}
+	}
+	// Taking it clears it
+	if got, _ := gr.Take(1); got != 0 {
+		t.Errorf("gain reduction %.2f dB after it was taken, want 0", got)
+	}
+}
@@ -0,0 +1,129 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/types"
+	"math"
+	"time"
+)
+
+// stripRamp is how long a channel strip change takes to reach the audio.
+// Gains move there linearly, so a polarity flip passes through silence and
+// a mute fades out instead of clicking.
+const stripRamp = 20 * time.Millisecond
+
+// ramp is a gain moving linearly to its target.
+type ramp struct {
+	value, target, step float64
+	left                int // Samples until value is target
+}
+
+// set moves the gain to target over steps samples (at once for 0).
+func (r *ramp) set(target float64, steps int) {
+	if target == r.target && r.left == 0 {
+		return
+	}
+	r.target = target
+	if steps == 0 {
+		r.value, r.left = target, 0
+		return
+	}
+	r.step = (target - r.value) / float64(steps)
+	r.left = steps
+}
+
+func (r *ramp) next() float64 {
+	if r.left > 0 {
+		if r.left--; r.left == 0 {
+			r.value = r.target
+		} else {
+			r.value += r.step
+		}
+	}
+	return r.value
+}
+
+// mixer applies the gains of the engine parameters: the boost and the gain,
+// polarity and mute of every input channel, and the pan of the monitor
+// pair. The engine calls it from its goroutine only.
+type mixer struct {
+	trims []ramp     // Per input channel, including the boost
+	slots [2]int     // Input channels of the monitor pair, chL and chR
+	pan   [2][2]ramp // Per slot, its gain into the left and right monitor channel
+	steps int        // Samples of a ramp
+}
+
+func newMixer(numCh, sampleRate int, params *types.EngineParams) *mixer {
+	m := &mixer{
+		trims: make([]ramp, numCh),
+		steps: max(int(stripRamp.Seconds()*float64(sampleRate)), 1),
+	}
+	m.apply(params, 0)
+	return m
+}
+
+// update ramps the gains to new parameters. The monitor pair switches to
+// new inputs at once.
+func (m *mixer) update(params *types.EngineParams) {
+	m.apply(params, m.steps)
+}
+
+func (m *mixer) apply(params *types.EngineParams, steps int) {
+	boost := params.Boost
+	if boost == 0 {
+		boost = 1.0
+	}
+	for c := range m.trims {
+		s := params.Strips[c]
+		gain := boost * math.Pow(10, s.Gain/20)
+		if s.Invert {
+			gain = -gain
+		}
+		if s.Mute {
+			gain = 0
+		}
+		m.trims[c].set(gain, steps)
+	}
+
+	// Without a pan each slot stays on its side; a panned channel in both
+	// slots is only mixed in once
+	m.slots = [2]int{params.ChLeft, params.ChRight}
+	for slot, ch := range m.slots {
+		left, right := float64(1-slot), float64(slot)
+		if pan := params.Strips[ch].Pan; pan != nil {
+			angle := (max(min(*pan, 1), -1) + 1) * math.Pi / 4
+			left, right = math.Cos(angle), math.Sin(angle)
+			if slot == 1 && m.slots[0] == ch {
+				left, right = 0, 0
+			}
+		}
+		m.pan[slot][0].set(left, steps)
+		m.pan[slot][1].set(right, steps)
+	}
+}
+
+// trim applies the gain of each channel to the interleaved buffer in place.
+func (m *mixer) trim(in []float32) {
+	numCh := len(m.trims)
+	for c := range m.trims {
+		r := &m.trims[c]
+		if r.left == 0 && r.value == 1 {
+			continue
+		}
+		for i := c; i < len(in); i += numCh {
+			in[i] *= float32(r.next())
+		}
+	}
+}
+
+// monitor mixes the monitor slots of frame into the monitor pair, clamped
+// to [-1.0, 1.0] like clampSample.
+func (m *mixer) monitor(in []float32, frame int) (float32, float32) {
+	numCh := len(m.trims)
+	l := clampSample(in, frame, m.slots[0], numCh)
+	r := clampSample(in, frame, m.slots[1], numCh)
+	var out [2]float64
+	for side := range out {
+		out[side] = float64(l)*m.pan[0][side].next() + float64(r)*m.pan[1][side].next()
+	}
+	return float32(max(min(out[0], 1), -1)), float32(max(min(out[1], 1), -1))
+}
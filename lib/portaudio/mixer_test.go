@@ -0,0 +1,97 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/types"
+	"math"
+	"testing"
+)
+
+// dc returns frames of numCh channels with every sample at 1.0.
+func dc(numCh, frames int) []float32 {
+	in := make([]float32, numCh*frames)
+	for i := range in {
+		in[i] = 1
+	}
+	return in
+}
+
+func TestMixerRampsWithoutSteps(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		from, to types.ChannelStrip
+		want     float32 // Gain once the ramp is done
+	}{
+		{"gain down", types.ChannelStrip{}, types.ChannelStrip{Gain: -20 * math.Log10(2)}, 0.5},
+		{"gain up", types.ChannelStrip{Gain: -20}, types.ChannelStrip{Gain: 6}, float32(math.Pow(10, 6.0/20))},
+		{"mute", types.ChannelStrip{}, types.ChannelStrip{Mute: true}, 0},
+		{"unmute", types.ChannelStrip{Mute: true}, types.ChannelStrip{}, 1},
+		{"invert", types.ChannelStrip{}, types.ChannelStrip{Invert: true}, -1},
+		{"mute inverted", types.ChannelStrip{Invert: true}, types.ChannelStrip{Invert: true, Mute: true}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMixer(1, 48000, &types.EngineParams{Strips: map[int]types.ChannelStrip{0: tc.from}})
+			first := float32(m.trims[0].value)
+			m.update(&types.EngineParams{Strips: map[int]types.ChannelStrip{0: tc.to}})
+
+			// Over three buffers of 480 frames; the ramp takes 960
+			gains := dc(1, 3*480)
+			for i := 0; i < len(gains); i += 480 {
+				m.trim(gains[i : i+480])
+			}
+			maxStep := math.Abs(float64(tc.want-first))/float64(m.steps) + 1e-6
+			prev := first
+			for i, g := range gains {
+				if math.Abs(float64(g-prev)) > maxStep {
+					t.Fatalf("gain steps from %.4f to %.4f at sample %d, want at most %.5f per sample", prev, g, i, maxStep)
+				}
+				if i >= m.steps-1 && g != tc.want {
+					t.Fatalf("gain %.4f at sample %d, want %.4f once the ramp of %d samples is done", g, i, tc.want, m.steps)
+				}
+				prev = g
+			}
+		})
+	}
+}
+
+func TestMixerStripsApplyAtStart(t *testing.T) {
+	m := newMixer(3, 48000, &types.EngineParams{
+		Boost:  2,
+		Strips: map[int]types.ChannelStrip{1: {Invert: true}, 2: {Mute: true, Gain: 6}},
+	})
+	in := dc(3, 2)
+	m.trim(in)
+	for i, want := range []float32{2, -2, 0, 2, -2, 0} {
+		if in[i] != want {
+			t.Errorf("sample %d (channel %d) is %v, want %v", i, i%3, in[i], want)
+		}
+	}
+}
+
+func TestMixerPanLaw(t *testing.T) {
+	const in = 0.5
+	half := in * float32(math.Sqrt(0.5)) // -3 dB in each channel at the center
+	pan := func(p float64) *float64 { return &p }
+	for _, tc := range []struct {
+		name        string
+		left, right int // Monitor slots
+		strips      map[int]types.ChannelStrip
+		want        [2]float32
+	}{
+		{"no pan", 0, 1, nil, [2]float32{in, 0}},
+		{"hard left", 0, 1, map[int]types.ChannelStrip{0: {Pan: pan(-1)}}, [2]float32{in, 0}},
+		{"center", 0, 1, map[int]types.ChannelStrip{0: {Pan: pan(0)}}, [2]float32{half, half}},
+		{"hard right", 0, 1, map[int]types.ChannelStrip{0: {Pan: pan(1)}}, [2]float32{0, in}},
+		{"beyond right", 0, 1, map[int]types.ChannelStrip{0: {Pan: pan(3)}}, [2]float32{0, in}},
+		// The same panned input in both slots is mixed in once
+		{"center in both slots", 0, 0, map[int]types.ChannelStrip{0: {Pan: pan(0)}}, [2]float32{half, half}},
+		{"unpanned in both slots", 0, 0, nil, [2]float32{in, in}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMixer(2, 48000, &types.EngineParams{ChLeft: tc.left, ChRight: tc.right, Strips: tc.strips})
+			l, r := m.monitor([]float32{in, 0}, 0)
+			if math.Abs(float64(l-tc.want[0])) > 1e-6 || math.Abs(float64(r-tc.want[1])) > 1e-6 {
+				t.Errorf("monitor pair (%.4f, %.4f), want (%.4f, %.4f)", l, r, tc.want[0], tc.want[1])
+			}
+		})
+	}
+}
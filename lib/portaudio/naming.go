@@ -0,0 +1,149 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/storage"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultNameTemplate is the take naming template used when none is
+// configured; it gives the historical rec_<unix>.wav names.
+const DefaultNameTemplate = "rec_{unix}"
+
+// TakeNameData holds the values of the naming template tokens for a take.
+type TakeNameData struct {
+	Start    time.Time
+	Device   string
+	Channels []int // 0-based input indexes
+	Take     int   // Take number within the session
+	Title    string
+	Session  string
+}
+
+// ExpandNameTemplate builds a take name from a template. Tokens:
+//
+//	{date}      start date, 2006-01-02
+//	{time}      start time, 15-04-05
+//	{unix}      start time in seconds since 1970
+//	{device}    input device name
+//	{channels}  recorded inputs, 1-based, e.g. 1-2-5
+//	{take}      take number in the session, 001
+//	{title}     title given in the "start" request
+//	{session}   session name
+//
+// Token values are made safe for file names. Separators left over by empty
+// tokens are collapsed (rec_{title}_{take} without title gives rec_001),
+// and a template that expands to nothing falls back to DefaultNameTemplate.
+func ExpandNameTemplate(template string, d TakeNameData) string {
+	if template == "" {
+		template = DefaultNameTemplate
+	}
+	inputs := make([]string, len(d.Channels))
+	for i, c := range d.Channels {
+		inputs[i] = strconv.Itoa(c + 1)
+	}
+	r := strings.NewReplacer(
+		"{date}", d.Start.Format("2006-01-02"),
+		"{time}", d.Start.Format("15-04-05"),
+		"{unix}", strconv.FormatInt(d.Start.Unix(), 10),
+		"{device}", SanitizeName(d.Device),
+		"{channels}", strings.Join(inputs, "-"),
+		"{take}", fmt.Sprintf("%03d", d.Take),
+		"{title}", SanitizeName(d.Title),
+		"{session}", SanitizeName(d.Session),
+	)
+	name := SanitizeName(r.Replace(template))
+	for _, sep := range []string{"__", "--", "  "} {
+		for strings.Contains(name, sep) {
+			name = strings.ReplaceAll(name, sep, sep[:1])
+		}
+	}
+	name = strings.Trim(name, "_- ")
+	if name == "" && template != DefaultNameTemplate {
+		return ExpandNameTemplate(DefaultNameTemplate, d)
+	}
+	return name
+}
+
+// SanitizeName makes s usable as a single file or folder name: path
+// separators, characters reserved on common file systems and control
+// characters become "_", and leading dots and surrounding spaces are
+// removed, so the name can't be hidden or climb out of its folder.
+func SanitizeName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7F || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	return strings.TrimLeft(strings.TrimSpace(s), ".")
+}
+
+// UniqueTakePath returns path, or path with "_2", "_3", ... appended, such
+// that neither a file path+ext nor a folder path exists yet.
+func UniqueTakePath(path, ext string) string {
+	candidate := path
+	for n := 2; ; n++ {
+		_, errFile := os.Stat(candidate + ext)
+		_, errDir := os.Stat(candidate)
+		if os.IsNotExist(errFile) && os.IsNotExist(errDir) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s_%d", path, n)
+	}
+}
+
+// TakeCounter numbers the takes of each session ("" for takes outside a
+// session) and persists the counters as JSON, so numbering continues after a
+// restart:
+//
+//	{"": 12, "Band rehearsal": 3}
+type TakeCounter struct {
+	mu     sync.Mutex
+	path   string
+	counts map[string]int
+}
+
+// LoadTakeCounter reads the counters stored at path. A missing file starts
+// all sessions at take 1.
+func LoadTakeCounter(path string) (*TakeCounter, error) {
+	c := &TakeCounter{path: path, counts: map[string]int{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c.counts); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Peek returns the next take number of a session without using it up.
+// Commit it once the take's files exist, so a take that fails to start
+// leaves no gap in the numbering.
+func (c *TakeCounter) Peek(session string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[session] + 1
+}
+
+// Commit records take as used in a session and saves the counters. The
+// counter never goes back, should two takes have peeked the same number.
+func (c *TakeCounter) Commit(session string, take int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[session] = max(c.counts[session], take)
+	data, err := json.MarshalIndent(c.counts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(c.path, data)
+}
@@ -0,0 +1,45 @@
+package portaudio
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestTakeCounterCountsCommittedTakes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store", ".takes.json")
+	c, err := LoadTakeCounter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A take that fails to start doesn't use its number up
+	if take := c.Peek("Band"); take != 1 {
+		t.Fatalf("first take %d, want 1", take)
+	}
+	if take := c.Peek("Band"); take != 1 {
+		t.Fatalf("take %d after a failed start, want 1 again", take)
+	}
+	for _, take := range []int{1, 2} {
+		if err := c.Commit("Band", take); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A take that peeked before another one committed keeps the count
+	if err := c.Commit("Band", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Commit("", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Numbering continues after a restart, per session
+	c, err = LoadTakeCounter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for session, want := range map[string]int{"Band": 3, "": 2, "New": 1} {
+		if take := c.Peek(session); take != want {
+			t.Errorf("session %q: next take %d, want %d", session, take, want)
+		}
+	}
+}
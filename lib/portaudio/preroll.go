@@ -0,0 +1,48 @@
+package portaudio
+
+// preRollBuffer keeps the most recent audio chunks while no take is running,
+// so a new take can start with the audio from just before Record was pressed.
+// It holds whole chunks and drops the oldest ones once more than maxFrames
+// sample frames are buffered.
+type preRollBuffer struct {
+	maxFrames int
+	chunks    [][]float32
+	frames    []int
+	total     int
+	channels  int // Of the buffered chunks
+}
+
+func newPreRollBuffer(maxFrames int) *preRollBuffer {
+	return &preRollBuffer{maxFrames: maxFrames}
+}
+
+// push appends a chunk of interleaved frames with the given channel count.
+// A chunk with another channel count than the buffered ones replaces them,
+// as the recorded channels changed.
+func (p *preRollBuffer) push(chunk []float32, channels int) {
+	if p.maxFrames <= 0 || channels <= 0 {
+		return
+	}
+	if channels != p.channels {
+		p.drain()
+		p.channels = channels
+	}
+	n := len(chunk) / channels
+	p.chunks = append(p.chunks, chunk)
+	p.frames = append(p.frames, n)
+	p.total += n
+	for len(p.chunks) > 1 && p.total-p.frames[0] >= p.maxFrames {
+		p.total -= p.frames[0]
+		p.chunks[0] = nil
+		p.chunks = p.chunks[1:]
+		p.frames = p.frames[1:]
+	}
+}
+
+// drain returns the buffered chunks, oldest first, and their channel count,
+// and empties the buffer.
+func (p *preRollBuffer) drain() ([][]float32, int) {
+	chunks, channels := p.chunks, p.channels
+	p.chunks, p.frames, p.total, p.channels = nil, nil, 0, 0
+	return chunks, channels
+}
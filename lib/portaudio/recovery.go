@@ -0,0 +1,274 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/types"
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RepairWavFiles scans dir (including split-track take folders) for WAV files
+// whose header doesn't match their length, i.e. takes that were never
+// finalized because the process died mid-recording, and rewrites their header
+// from the amount of audio actually on disk. It returns the repaired paths.
+//
+// Only headers this recorder writes while a take is open are repaired:
+//   - the placeholder / periodically updated header (RIFF or RF64, with or
+//     without bext), recognised by the JUNK / ds64 chunk reserved at offset
+//     12 and sizes that describe the header plus whole frames of audio and
+//     nothing after them;
+//   - an all-zero 44-byte placeholder from older versions, which always
+//     recorded stereo at the configured sample rate.
+//
+// Anything else, such as WAV files copied into the folder or carrying
+// chunks after the audio, is left untouched, and so are hidden folders like
+// the trash. A repair only drops a partial frame after the audio.
+func RepairWavFiles(dir string, sampleRate int) []string {
+	var repaired []string
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || filepath.Ext(path) != ".wav" {
+			return nil
+		}
+		ok, err := repairWavFile(path, sampleRate)
+		if err != nil {
+			log.Printf("[RECOVERY] Could not repair %s: %v", path, err)
+		} else if ok {
+			repaired = append(repaired, path)
+		}
+		return nil
+	})
+	return repaired
+}
+
+// repairWavFile fixes one file and reports whether it needed repairing.
+func repairWavFile(path string, defaultRate int) (bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	// Large enough for every header we write, bext chunk included
+	header := make([]byte, 4096)
+	n, _ := f.ReadAt(header, 0)
+	if n < legacyHeaderSize {
+		// Shorter than a header: nothing was ever recorded into it
+		return false, nil
+	}
+	header = header[:n]
+
+	if bytes.Equal(header[:legacyHeaderSize], make([]byte, legacyHeaderSize)) {
+		format := types.WavFormat{Channels: 2, SampleRate: defaultRate, BitDepth: 16}
+		frames := (st.Size() - legacyHeaderSize) / 4
+		if err := f.Truncate(legacyHeaderSize + frames*4); err != nil {
+			return false, err
+		}
+		if _, err := f.WriteAt(wavHeader(format, frames, 0, false), 0); err != nil {
+			return false, err
+		}
+		logRepair(path, format, frames)
+		return true, nil
+	}
+
+	layout, ok := parseWavLayout(header)
+	if !ok || !layout.reserved {
+		return false, nil
+	}
+	// A finalized take's RIFF size covers the whole file
+	if layout.riffSize+8 == st.Size() {
+		return false, nil
+	}
+	// An open take declares its header and the whole frames written up to
+	// the last header update, and the file holds at least that much
+	frameSize := int64(layout.format.BlockAlign())
+	if layout.riffSize != layout.dataStart-8+layout.dataSize || layout.dataSize%frameSize != 0 ||
+		layout.dataStart+layout.dataSize > st.Size() {
+		return false, nil
+	}
+
+	// Chunks after the declared audio mean the file was finished and
+	// tagged by another program, not cut short
+	if chunksFollow(f, layout.dataStart+layout.dataSize+layout.dataSize%2, st.Size()) {
+		return false, nil
+	}
+
+	// Drop a trailing partial frame left by the interrupted write
+	frames := (st.Size() - layout.dataStart) / frameSize
+	size := layout.dataStart + frames*frameSize
+	if err := f.Truncate(size); err != nil {
+		return false, err
+	}
+	riffSize := size - 8
+	if size%2 == 1 {
+		// Word-align the data chunk with a pad byte
+		if _, err := f.WriteAt([]byte{0}, size); err != nil {
+			return false, err
+		}
+		riffSize++
+	}
+	if err := layout.patchSizes(f, riffSize, frames*frameSize, frames); err != nil {
+		return false, err
+	}
+	logRepair(path, layout.format, frames)
+	return true, nil
+}
+
+// chunksFollow reports whether the file holds nothing but well-formed
+// RIFF chunks from off to its end at size.
+func chunksFollow(f *os.File, off, size int64) bool {
+	if off >= size {
+		return false
+	}
+	head := make([]byte, 8)
+	for off < size {
+		if _, err := f.ReadAt(head, off); err != nil {
+			return false
+		}
+		for _, c := range head[:4] {
+			if c < 0x20 || c > 0x7E {
+				return false
+			}
+		}
+		n := int64(binary.LittleEndian.Uint32(head[4:]))
+		off += 8 + n + n%2
+	}
+	// Writers don't always pad the last chunk
+	return off <= size+1
+}
+
+func logRepair(path string, format types.WavFormat, frames int64) {
+	duration := time.Duration(frames) * time.Second / time.Duration(format.SampleRate)
+	log.Printf("[RECOVERY] Repaired %s: %d channel(s), %d Hz, %d frames (%s)", path, format.Channels, format.SampleRate, frames, duration.Round(time.Millisecond))
+}
+
+// wavLayout is where the size fields of a WAV header are.
+type wavLayout struct {
+	format     types.WavFormat
+	riffSize   int64 // As declared in the header (ds64 for RF64)
+	dataSize   int64 // Likewise
+	reserved   bool  // JUNK / ds64 chunk at offset 12 that can hold RF64 sizes
+	dataStart  int64 // Offset of the first audio byte
+	factOffset int64 // Offset of the fact chunk's sample count, 0 if absent
+}
+
+// parseWavLayout walks the chunks at the start of the file up to the data
+// chunk. It only accepts the sample formats this recorder writes.
+func parseWavLayout(header []byte) (wavLayout, bool) {
+	var l wavLayout
+	magic := string(header[0:4])
+	if (magic != "RIFF" && magic != "RF64") || string(header[8:12]) != "WAVE" {
+		return l, false
+	}
+	l.riffSize = int64(binary.LittleEndian.Uint32(header[4:8]))
+
+	haveFmt := false
+	for off := 12; off+8 <= len(header); {
+		id := string(header[off : off+4])
+		size := int(binary.LittleEndian.Uint32(header[off+4 : off+8]))
+		body := header[off+8:]
+		switch id {
+		case "JUNK", "ds64":
+			if off != 12 || size != 28 || len(body) < 28 {
+				break
+			}
+			l.reserved = true
+			if id == "ds64" && magic == "RF64" {
+				l.riffSize = int64(binary.LittleEndian.Uint64(body[0:8]))
+				l.dataSize = int64(binary.LittleEndian.Uint64(body[8:16]))
+			}
+		case "fmt ":
+			if size < 16 || len(body) < size {
+				return l, false
+			}
+			tag := binary.LittleEndian.Uint16(body[0:2])
+			if tag == wavFormatExtensible && size >= 26 {
+				tag = binary.LittleEndian.Uint16(body[24:26])
+			}
+			l.format.Channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			l.format.SampleRate = int(binary.LittleEndian.Uint32(body[4:8]))
+			l.format.BitDepth = int(binary.LittleEndian.Uint16(body[14:16]))
+			switch {
+			case tag == wavFormatPCM && (l.format.BitDepth == 16 || l.format.BitDepth == 24):
+			case tag == wavFormatIEEEFloat && l.format.BitDepth == 32:
+				l.format.Float = true
+			default:
+				return l, false
+			}
+			haveFmt = true
+		case "fact":
+			l.factOffset = int64(off + 8)
+		case "data":
+			l.dataStart = int64(off + 8)
+			if magic != "RF64" {
+				l.dataSize = int64(size)
+			}
+			ok := haveFmt && l.format.Channels > 0 && l.format.SampleRate > 0
+			return l, ok
+		}
+		off += 8 + size + size%2
+	}
+	return l, false
+}
+
+// patchSizes rewrites the size fields of the header in place, switching to
+// RF64 if the sizes don't fit in 32 bits and the header has room for ds64.
+func (l wavLayout) patchSizes(f *os.File, riffSize, dataSize, frames int64) error {
+	head := make([]byte, 8)
+	dataSizeField := make([]byte, 4)
+	if l.reserved && (riffSize > maxRiffSize || dataSize > maxRiffSize) {
+		ds64 := make([]byte, 36)
+		copy(ds64[0:], "ds64")
+		binary.LittleEndian.PutUint32(ds64[4:], 28)
+		binary.LittleEndian.PutUint64(ds64[8:], uint64(riffSize))
+		binary.LittleEndian.PutUint64(ds64[16:], uint64(dataSize))
+		binary.LittleEndian.PutUint64(ds64[24:], uint64(frames))
+		if _, err := f.WriteAt(ds64, 12); err != nil {
+			return err
+		}
+		copy(head, "RF64")
+		binary.LittleEndian.PutUint32(head[4:], maxRiffSize)
+		binary.LittleEndian.PutUint32(dataSizeField, maxRiffSize)
+	} else {
+		if l.reserved {
+			junk := make([]byte, 36)
+			copy(junk[0:], "JUNK")
+			binary.LittleEndian.PutUint32(junk[4:], 28)
+			if _, err := f.WriteAt(junk, 12); err != nil {
+				return err
+			}
+		}
+		copy(head, "RIFF")
+		binary.LittleEndian.PutUint32(head[4:], uint32(riffSize))
+		binary.LittleEndian.PutUint32(dataSizeField, uint32(dataSize))
+	}
+	if _, err := f.WriteAt(head, 0); err != nil {
+		return err
+	}
+	if l.factOffset > 0 {
+		fact := make([]byte, 4)
+		binary.LittleEndian.PutUint32(fact, uint32(min(frames, maxRiffSize)))
+		if _, err := f.WriteAt(fact, l.factOffset); err != nil {
+			return err
+		}
+	}
+	_, err := f.WriteAt(dataSizeField, l.dataStart-4)
+	return err
+}
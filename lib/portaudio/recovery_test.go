@@ -0,0 +1,80 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/types"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+var recoveryFormat = types.WavFormat{Channels: 2, SampleRate: 48000, BitDepth: 16}
+
+// writeTestWav writes header followed by frames of stereo 16-bit audio and
+// extra bytes, and returns the file's path.
+func writeTestWav(t *testing.T, path string, header []byte, frames int, extra []byte) string {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	audio := make([]byte, frames*recoveryFormat.BlockAlign())
+	for i := range audio {
+		audio[i] = byte(i*7 + 1)
+	}
+	data := slices.Concat(header, audio, extra)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRepairWavFiles(t *testing.T) {
+	dir := t.TempDir()
+	placeholder := wavHeader(recoveryFormat, 0, 0, true)
+	finished := wavHeader(recoveryFormat, 1000, 0, true)
+
+	// Takes cut short: placeholder header, and a header updated at 500
+	// frames, each with a partial frame at the end
+	crashed := writeTestWav(t, filepath.Join(dir, "crashed.wav"), placeholder, 1000, []byte{1, 2})
+	updated := writeTestWav(t, filepath.Join(dir, "take", "updated_ch01.wav"), wavHeader(recoveryFormat, 500, 0, true), 1000, []byte{3})
+
+	// Files that must stay as they are
+	list := []byte("LIST\x04\x00\x00\x00INFO")
+	var foreign bytes.Buffer
+	foreign.WriteString("RIFF")
+	binary.Write(&foreign, binary.LittleEndian, uint32(1<<20)) // Claims more than there is
+	foreign.Write(wavHeader(recoveryFormat, 1000, 0, false)[8:])
+	untouched := []string{
+		writeTestWav(t, filepath.Join(dir, "finished.wav"), finished, 1000, nil),
+		writeTestWav(t, filepath.Join(dir, "tagged.wav"), finished, 1000, list),
+		writeTestWav(t, filepath.Join(dir, "foreign.wav"), foreign.Bytes(), 1000, []byte{9}),
+		writeTestWav(t, filepath.Join(dir, ".trash", "crashed.wav"), placeholder, 1000, []byte{1}),
+		writeTestWav(t, filepath.Join(dir, "Session", ".hidden", "crashed.wav"), placeholder, 1000, nil),
+	}
+	before := make(map[string][]byte)
+	for _, path := range untouched {
+		before[path], _ = os.ReadFile(path)
+	}
+
+	repaired := RepairWavFiles(dir, 48000)
+	slices.Sort(repaired)
+	if want := []string{crashed, updated}; !slices.Equal(repaired, want) {
+		t.Fatalf("repaired %v, want %v", repaired, want)
+	}
+	for _, path := range repaired {
+		data, _ := os.ReadFile(path)
+		if want := wavHeader(recoveryFormat, 1000, 0, true); !bytes.Equal(data[:len(want)], want) {
+			t.Errorf("%s: header not rewritten for 1000 frames", path)
+		}
+		if want := len(placeholder) + 1000*recoveryFormat.BlockAlign(); len(data) != want {
+			t.Errorf("%s: %d bytes after repair, want %d", path, len(data), want)
+		}
+	}
+	for _, path := range untouched {
+		if data, _ := os.ReadFile(path); !bytes.Equal(data, before[path]) {
+			t.Errorf("%s was modified", path)
+		}
+	}
+}
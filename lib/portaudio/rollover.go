@@ -0,0 +1,145 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/config"
+	"behringerRecorder/lib/types"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RolloverEvent reports that a take continued in a new part. File names are
+// relative to the take's folder, e.g. "rec_1700000000_part002.wav", or
+// "rec_1700000000/rec_1700000000_part002_ch01.wav" for split-track takes.
+type RolloverEvent struct {
+	Part     int      `json:"part"`     // Number of the new part (2 = second)
+	Samples  int64    `json:"samples"`  // Sample frames in the finished part
+	Previous []string `json:"previous"` // Files of the finished part
+	Files    []string `json:"files"`    // Files of the new part
+}
+
+// partLimits are the rollover limits of the parts of a take; 0 = no limit.
+type partLimits struct {
+	frames int64 // Sample frames per part
+	bytes  int64 // File size per part (of each track for split-track takes)
+}
+
+func newPartLimits(cfg *config.Config) partLimits {
+	return partLimits{
+		frames: int64(cfg.SplitEveryMinutes * 60 * float64(cfg.SampleRate)),
+		bytes:  int64(cfg.SplitEveryMB * 1024 * 1024),
+	}
+}
+
+// reached reports whether the current part of the take is full. The duration
+// limit is exact, since writeTake splits chunks at it; the size limit is
+// checked between chunks, so a part can exceed it by up to one chunk (and
+// for FLAC by the block the encoder still holds).
+func (l partLimits) reached(state *types.AppState) bool {
+	if state.SamplesWrote == 0 {
+		return false
+	}
+	if l.frames > 0 && state.SamplesWrote >= l.frames {
+		return true
+	}
+	return l.bytes > 0 && partSize(state) >= l.bytes
+}
+
+// partSize returns the size of the (first) file of the current part.
+func partSize(state *types.AppState) int64 {
+	f := state.File
+	if f == nil && len(state.TrackFiles) > 0 {
+		f = state.TrackFiles[0]
+	}
+	if f == nil {
+		return 0
+	}
+	size, _ := f.Seek(0, io.SeekCurrent)
+	return size
+}
+
+// writeTake writes a chunk to the current part of the take, rolling over to
+// a new part whenever the current one is full, and returns the rollovers
+// that happened. If a new part can't be created the take continues in the
+// current part without limits. Callers must hold state.Mu.
+func writeTake(state *types.AppState, chunk []float32, q *quantizer, limits *partLimits) []RolloverEvent {
+	ch := state.FileFormat.Channels
+	if ch <= 0 || len(chunk)%ch != 0 {
+		return nil
+	}
+	var events []RolloverEvent
+	for len(chunk) > 0 {
+		if limits.reached(state) {
+			ev, err := rollover(state)
+			if err != nil {
+				log.Printf("[AUDIO] Could not start part %d, continuing in part %d: %v", state.TakePart+1, state.TakePart, err)
+				*limits = partLimits{}
+			} else {
+				events = append(events, ev)
+			}
+		}
+		frames := int64(len(chunk) / ch)
+		if limits.frames > 0 {
+			frames = min(frames, limits.frames-state.SamplesWrote)
+		}
+		writeChunk(state, chunk[:frames*int64(ch)], q)
+		chunk = chunk[frames*int64(ch):]
+	}
+	return events
+}
+
+// rollover finalizes the current part of the take and continues it in the
+// next one. The new part has the same format; Broadcast Wave metadata is
+// moved on to the part's first sample. Callers must hold state.Mu.
+func rollover(state *types.AppState) (RolloverEvent, error) {
+	format := state.FileFormat
+	if format.Bext != nil {
+		bext := *format.Bext
+		bext.TimeReference += uint64(state.SamplesWrote)
+		bext.OriginationTime = bext.OriginationTime.Add(time.Duration(state.SamplesWrote) * time.Second / time.Duration(format.SampleRate))
+		format.Bext = &bext
+	}
+	part := state.TakePart + 1
+	file, tracks, encoders, err := CreateTake(state.TakePath, part, state.RecordingChannels(), len(state.TrackFiles) > 0, format)
+	if err != nil {
+		return RolloverEvent{}, err
+	}
+
+	ev := RolloverEvent{
+		Part:     part,
+		Samples:  state.SamplesWrote,
+		Previous: takeFileNames(state.TakePath, state.File, state.TrackFiles),
+		Files:    takeFileNames(state.TakePath, file, tracks),
+	}
+	if err := FinalizeTake(state.File, state.TrackFiles, state.Encoders, state.FileFormat, state.SamplesWrote, state.CuePoints); err != nil {
+		log.Printf("[AUDIO] Could not finalize part %d: %v", state.TakePart, err)
+	}
+
+	state.File = file
+	state.TrackFiles = tracks
+	state.Encoders = encoders
+	state.FileFormat = format
+	state.TakePart = part
+	state.SamplesWrote = 0
+	state.CuePoints = nil
+	return ev, nil
+}
+
+// takeFileNames returns the names of the files of a take part relative to
+// the take's folder.
+func takeFileNames(takePath string, file *os.File, tracks []*os.File) []string {
+	var names []string
+	for _, f := range append([]*os.File{file}, tracks...) {
+		if f == nil {
+			continue
+		}
+		name, err := filepath.Rel(filepath.Dir(takePath), f.Name())
+		if err != nil {
+			name = filepath.Base(f.Name())
+		}
+		names = append(names, filepath.ToSlash(name))
+	}
+	return names
+}
@@ -0,0 +1,110 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/config"
+	"behringerRecorder/lib/types"
+	"fmt"
+	"time"
+)
+
+// Source backend names accepted by the `source` key in config.yaml.
+const (
+	SourcePortAudio = "portaudio"
+	SourceSynthetic = "synthetic"
+	SourceFile      = "file"
+)
+
+// AudioSource is a capture backend the engine pulls audio from.
+//
+// Read fills buf with the next block of frames (the frame count passed to
+// Open) as interleaved float32 samples in the range [-1.0, 1.0]:
+//
+//	[frame0_ch0, frame0_ch1, ..., frame0_chN, frame1_ch0, frame1_ch1, ...]
+//
+// so len(buf) must be framesPerBuffer * Channels(). Read returns io.EOF when
+// the source has no more audio (e.g. a non-looping file replay); any other
+// error means the block should be skipped.
+type AudioSource interface {
+	Open(framesPerBuffer int) error
+	Read(buf []float32) error
+	Close() error
+	Channels() int
+	SampleRate() int
+}
+
+// NewAudioSource builds the source of the backend of dev. For the synthetic
+// and file backends dev is the entry returned by VirtualDevices and only
+// serves as a label.
+func NewAudioSource(cfg *config.Config, dev types.Device) (AudioSource, error) {
+	switch dev.Backend {
+	case "", SourcePortAudio:
+		if hardware == nil {
+			return nil, fmt.Errorf("built without PortAudio support")
+		}
+		return hardware(dev, cfg.SampleRate)
+	case SourceSynthetic:
+		return NewSyntheticSource(cfg.SyntheticSignals, cfg.SyntheticAmplitude, cfg.SampleRate)
+	case SourceFile:
+		src, err := NewFileSource(cfg.ReplayFile, cfg.ReplayLoop)
+		if err != nil {
+			return nil, err
+		}
+		if src.SampleRate() != cfg.SampleRate {
+			src.Close()
+			return nil, fmt.Errorf("replay file is %d Hz but sample_rate is %d", src.SampleRate(), cfg.SampleRate)
+		}
+		return src, nil
+	}
+	return nil, fmt.Errorf("unknown audio source %q", dev.Backend)
+}
+
+// VirtualDevices returns the device list for the non-PortAudio backends, so
+// the device picker and StartAudioEngine work the same for every source.
+func VirtualDevices(cfg *config.Config) ([]types.Device, error) {
+	src, err := NewAudioSource(cfg, types.Device{Backend: cfg.Source})
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	name := "Synthetic Generator"
+	if cfg.Source == SourceFile {
+		name = "File Replay: " + cfg.ReplayFile
+	}
+	return []types.Device{{Name: name, Inputs: src.Channels(), Backend: cfg.Source}}, nil
+}
+
+// hardware opens the devices of the PortAudio backend. The PortAudio
+// bindings need cgo and libportaudio, so they live in package hardware,
+// which registers them; without it only the software sources work.
+var hardware func(dev types.Device, sampleRate int) (AudioSource, error)
+
+// RegisterHardware provides the PortAudio backend, see package hardware.
+func RegisterHardware(open func(dev types.Device, sampleRate int) (AudioSource, error)) {
+	hardware = open
+}
+
+// pacer makes software sources deliver blocks at the rate a sound card
+// would, so downstream consumers see the same timing as with real hardware.
+type pacer struct {
+	block time.Duration
+	next  time.Time
+}
+
+func newPacer(frames, sampleRate int) pacer {
+	return pacer{block: time.Duration(frames) * time.Second / time.Duration(sampleRate)}
+}
+
+// wait blocks until the current block is due. If we fell behind by more
+// than one block (e.g. the process was suspended) the clock is reset
+// instead of bursting to catch up.
+func (p *pacer) wait() {
+	now := time.Now()
+	if p.next.IsZero() || now.Sub(p.next) > p.block {
+		p.next = now
+	}
+	if d := p.next.Sub(now); d > 0 {
+		time.Sleep(d)
+	}
+	p.next = p.next.Add(p.block)
+}
@@ -0,0 +1,85 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/audiofile"
+	"fmt"
+	"io"
+	"log"
+)
+
+// FileSource replays a recording (WAV, RF64 or FLAC, see package audiofile)
+// as if it were an input device, which covers every file this recorder
+// writes.
+type FileSource struct {
+	r         *audiofile.Reader
+	loop      bool
+	exhausted bool
+	pace      pacer
+}
+
+// NewFileSource opens path and parses its header. With loop set the file
+// restarts from the beginning at EOF instead of ending the stream.
+func NewFileSource(path string, loop bool) (*FileSource, error) {
+	if path == "" {
+		return nil, fmt.Errorf("replay_file is not set")
+	}
+	r, err := audiofile.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSource{r: r, loop: loop}, nil
+}
+
+func (s *FileSource) Open(framesPerBuffer int) error {
+	s.pace = newPacer(framesPerBuffer, s.SampleRate())
+	s.exhausted = false
+	return s.r.Rewind()
+}
+
+func (s *FileSource) Read(buf []float32) error {
+	if s.exhausted {
+		return io.EOF
+	}
+	s.pace.wait()
+
+	filled := 0
+	rewound := false // Rewound without reading a frame since: the file is empty
+	for filled < len(buf) {
+		n, err := s.r.Read(buf[filled:])
+		filled += n * s.Channels()
+		if n > 0 {
+			rewound = false
+		}
+		if err != nil && err != io.EOF {
+			// A damaged file ends the replay where it breaks
+			log.Printf("[AUDIO] Replay stopped: %v", err)
+			err = io.EOF
+			s.loop = false
+		}
+		if err == io.EOF {
+			if !s.loop || rewound {
+				break
+			}
+			if err := s.r.Rewind(); err != nil {
+				return err
+			}
+			rewound = true
+		}
+	}
+
+	// Pad the final partial block with silence; the next Read reports EOF.
+	for i := filled; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	if filled < len(buf) {
+		s.exhausted = true
+		if filled == 0 {
+			return io.EOF
+		}
+	}
+	return nil
+}
+
+func (s *FileSource) Close() error    { return s.r.Close() }
+func (s *FileSource) Channels() int   { return s.r.Info().Channels }
+func (s *FileSource) SampleRate() int { return s.r.Info().SampleRate }
@@ -1,52 +1,201 @@
 package portaudio
 
 import (
+	"behringerRecorder/lib/config"
 	"behringerRecorder/lib/types"
-	"encoding/binary"
+	"os"
+	"time"
 )
 
 // StartStorageWorker starts a goroutine that processes audio chunks and writes them to disk.
 //
 // Data Flow:
-// 1. Receives float32 audio chunks from recordChan (stereo interleaved: [L, R, L, R, ...])
-// 2. Converts each float32 sample to int16:
-//   - float32 range: -1.0 to +1.0
-//   - int16 range: -32768 to +32767
-//   - Conversion: float32 * 32767 ≈ int16
+// 1. Receives float32 audio chunks from recordChan (interleaved: [ch0, ch1, ..., chN, ch0, ...])
+// 2. Converts each float32 sample to the take's sample format (state.FileFormat):
+//   - 16-bit: round(float32 * 32768) → int16 [-32768, 32767]
+//   - 24-bit: round(float32 * 8388608) → int24 [-8388608, 8388607]
+//   - 32-bit float: written unchanged
 //
-// 3. Writes int16 pairs (stereo samples) as little-endian bytes to state.File
-// 4. Tracks total samples written in state.SamplesWrote
+// 3. Writes the samples as little-endian bytes to state.File, or in
+// split-track mode de-interleaves them into one mono file per channel
+// (state.TrackFiles), so all tracks stay sample-aligned
+// 4. Tracks total sample frames written in state.SamplesWrote
 //
 // Data Format:
 //
 //	Input (float32): 32-bit IEEE 754 floating point [-1.0 to 1.0]
-//	Output (int16): 16-bit signed integer [-32768 to 32767]
+//	Output: int16, int24 or float32 samples (see encodeSamples)
 //	Encoding: Little Endian (LSB first, native for x86/ARM)
-//	Layout: Stereo interleaved [Left, Right, Left, Right, ...]
+//	Layout: Interleaved frames of state.FileFormat.Channels samples
 //
-// Example:
+// Example (stereo 16-bit take):
 //
 //	Input chunk: [0.5, -0.3, 0.1, 0.2]
-//	Converted: [16384, -9831, 3277, 6554] (approx)
-//	On disk (hex): 00 40 59 D8 0C 0C 4A 19
-func StartStorageWorker(state *types.AppState, recordChan <-chan []float32) {
+//	Converted: [16384, -9830, 3277, 6554] (approx)
+//	On disk (hex): 00 40 9A D9 CD 0C 9A 19
+//
+// FLAC: for FLAC takes the integer samples go to state.Encoders instead,
+// which compress them block by block (see FlacEncoder).
+//
+// Dither: with cfg.Dither set to "tpdf" or "shaped" the integer conversion
+// adds TPDF dither (optionally noise shaped) before rounding, see quantizer.
+//
+// Pre-roll: while no take is running the worker keeps the last
+// cfg.PreRollSeconds of chunks, and writes them ahead of the first chunk of
+// the next take, so the take includes the audio from before "start". Chunks
+// with other recorded channels than the take's are dropped.
+//
+// Broadcast Wave: the first chunk written to a take sets the time reference
+// of its bext metadata (in samples since midnight) to the wall clock time of
+// the take's first sample, counted back from the time the chunk arrives.
+// It is late by the chunks still waiting in recordChan and the latency of
+// the source, usually a buffer or two. Later parts of a rolled over take
+// continue from it sample-exactly.
+//
+// Pause: while state.IsPaused is set chunks are discarded, and the take
+// continues seamlessly on resume.
+//
+// Rollover: with cfg.SplitEveryMinutes or cfg.SplitEveryMB set, a long take
+// is split into parts. Once the current part reaches the limit it is
+// finalized and the next chunk goes to a new part (rec_<ts>_part002.wav,
+// ...), see writeTake; no sample is lost between parts. onRollover (may be
+// nil) is called for every new part, after state.Mu is released.
+//
+// Crash safety: every cfg.HeaderUpdateSeconds the headers of the open take
+// are rewritten with the current sample count and synced to disk, so after a
+// crash the file is playable up to that point (and RepairWavFiles can
+// recover the rest on the next start).
+func StartStorageWorker(state *types.AppState, cfg *config.Config, recordChan <-chan []float32, onRollover func(RolloverEvent)) {
+	preRoll := newPreRollBuffer(int(cfg.PreRollSeconds * float64(cfg.SampleRate)))
+	headerInterval := time.Duration(cfg.HeaderUpdateSeconds * float64(time.Second))
+	dither, _ := ParseDither(cfg.Dither)
+	q := newQuantizer(dither)
 	go func() {
+		lastHeaderUpdate := time.Now()
+		limits := newPartLimits(cfg)
 		for chunk := range recordChan {
+			var rollovers []RolloverEvent
 			state.Mu.Lock()
-			if state.IsRecording {
-				// Process pairs of float32 samples (stereo)
-				for i := 0; i < len(chunk); i += 2 {
-					sL, sR := chunk[i], chunk[i+1]
-					// Convert float32 [-1.0, 1.0] to int16 [-32768, 32767]
-					iL, iR := int16(sL*32767), int16(sR*32767)
-					// Write as little-endian int16 values
-					binary.Write(state.File, binary.LittleEndian, iL)
-					binary.Write(state.File, binary.LittleEndian, iR)
+			if state.IsRecording && !state.IsPaused {
+				// The engine makes chunks of cfg.BufferSize frames with
+				// the recorded channels it used at the time. Chunks made
+				// before the take's channels reached it don't fit the
+				// take and are dropped.
+				ch := state.FileFormat.Channels
+				pending, pendingCh := preRoll.drain()
+				if pendingCh != ch {
+					pending = nil
 				}
-				// Track number of stereo sample pairs written
-				state.SamplesWrote += int64(len(chunk) / 2)
+				if len(chunk) != cfg.BufferSize*ch {
+					chunk = nil
+				}
+				if chunk != nil {
+					pending = append(pending, chunk)
+				}
+				// The first audio of a take dates it (see Broadcast Wave
+				// above): its last sample was captured about now, its
+				// first one, pre-roll included, that many frames earlier
+				if bext := state.FileFormat.Bext; bext != nil && ch > 0 && state.SamplesWrote == 0 && state.TakePart <= 1 && len(pending) > 0 {
+					var frames int64
+					for _, c := range pending {
+						frames += int64(len(c) / ch)
+					}
+					first := time.Now().Add(-time.Duration(frames) * time.Second / time.Duration(cfg.SampleRate))
+					bext.TimeReference = timeReference(first, cfg.SampleRate)
+				}
+				for _, c := range pending {
+					rollovers = append(rollovers, writeTake(state, c, q, &limits)...)
+				}
+			} else if !state.IsRecording {
+				preRoll.push(chunk, len(chunk)/cfg.BufferSize)
+				q.reset()
+				limits = newPartLimits(cfg)
+			}
+			if state.IsRecording && headerInterval > 0 && time.Since(lastHeaderUpdate) >= headerInterval {
+				updateHeaders(state)
+				lastHeaderUpdate = time.Now()
 			}
 			state.Mu.Unlock()
+
+			if onRollover != nil {
+				for _, ev := range rollovers {
+					onRollover(ev)
+				}
+			}
 		}
 	}()
 }
+
+// updateHeaders refreshes the headers of every file of the current take.
+// Callers must hold state.Mu.
+func updateHeaders(state *types.AppState) {
+	if len(state.Encoders) > 0 {
+		for _, e := range state.Encoders {
+			e.Sync()
+		}
+		return
+	}
+	if state.File != nil {
+		UpdateWavHeader(state.File, state.FileFormat, state.SamplesWrote)
+	}
+	mono := state.FileFormat
+	mono.Channels = 1
+	for _, f := range state.TrackFiles {
+		UpdateWavHeader(f, mono, state.SamplesWrote)
+	}
+}
+
+// writeChunk appends one chunk to the current take and returns the number of
+// sample frames written, converting samples with q. Callers must hold state.Mu.
+func writeChunk(state *types.AppState, chunk []float32, q *quantizer) int64 {
+	ch := state.FileFormat.Channels
+	// The storage worker already dropped chunks of other channel counts
+	if ch <= 0 || len(chunk)%ch != 0 {
+		return 0
+	}
+	switch {
+	case len(state.Encoders) > 0:
+		writeEncoders(state.Encoders, quantizeSamples(state.FileFormat, chunk, q))
+	case len(state.TrackFiles) == ch:
+		writeTracks(state.TrackFiles, encodeSamples(state.FileFormat, chunk, q), state.FileFormat.SampleSize())
+	default:
+		state.File.Write(encodeSamples(state.FileFormat, chunk, q))
+	}
+	// Track number of sample frames written
+	frames := int64(len(chunk) / ch)
+	state.SamplesWrote += frames
+	return frames
+}
+
+// writeEncoders hands interleaved samples to the encoder of the take, or
+// de-interleaves them into one mono stream per encoder of a split-track take.
+func writeEncoders(encoders []types.Encoder, samples []int32) {
+	if len(encoders) == 1 {
+		encoders[0].Write(samples)
+		return
+	}
+	numCh := len(encoders)
+	frames := len(samples) / numCh
+	track := make([]int32, frames)
+	for c, e := range encoders {
+		for i := 0; i < frames; i++ {
+			track[i] = samples[i*numCh+c]
+		}
+		e.Write(track)
+	}
+}
+
+// writeTracks splits a buffer of interleaved encoded frames into one mono
+// stream per file, `sampleSize` bytes per sample.
+func writeTracks(files []*os.File, buf []byte, sampleSize int) {
+	numCh := len(files)
+	frames := len(buf) / (numCh * sampleSize)
+	track := make([]byte, frames*sampleSize)
+	for c, f := range files {
+		for i := 0; i < frames; i++ {
+			src := (i*numCh + c) * sampleSize
+			copy(track[i*sampleSize:(i+1)*sampleSize], buf[src:src+sampleSize])
+		}
+		f.Write(track)
+	}
+}
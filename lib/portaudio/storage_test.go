@@ -0,0 +1,111 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/config"
+	"behringerRecorder/lib/types"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// constChunk returns a chunk of frames with every sample of channel c at
+// value[c].
+func constChunk(frames int, value ...float32) []float32 {
+	chunk := make([]float32, frames*len(value))
+	for i := range chunk {
+		chunk[i] = value[i%len(value)]
+	}
+	return chunk
+}
+
+func TestStorageWorkerDropsOtherChannelCounts(t *testing.T) {
+	cfg := &config.Config{SampleRate: 48000, BufferSize: 100, PreRollSeconds: 1}
+	state := &types.AppState{}
+	recordChan := make(chan []float32)
+	StartStorageWorker(state, cfg, recordChan, nil)
+
+	// Pre-roll recorded with four channels, then the routing changes to
+	// two: the second pre-roll replaces the first
+	recordChan <- constChunk(100, 0.1, 0.1, 0.1, 0.1)
+	recordChan <- constChunk(100, 0.25, -0.25)
+
+	format := types.WavFormat{Channels: 2, SampleRate: cfg.SampleRate, BitDepth: 16}
+	file, _, _, err := CreateTake(filepath.Join(t.TempDir(), "rec"), 1, []int{0, 1}, false, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Mu.Lock()
+	state.File, state.FileFormat, state.IsRecording = file, format, true
+	state.Mu.Unlock()
+
+	// A chunk still made with four channels, a half one and a fitting one
+	recordChan <- constChunk(100, 0.1, 0.1, 0.1, 0.1)
+	recordChan <- constChunk(50, 0.1, 0.1)
+	recordChan <- constChunk(100, 0.5, -0.5)
+	recordChan <- nil // Handled once the one before it is written
+	close(recordChan)
+
+	state.Mu.Lock()
+	frames := state.SamplesWrote
+	FinalizeTake(state.File, nil, nil, format, frames, nil)
+	state.Mu.Unlock()
+	if frames != 200 {
+		t.Fatalf("%d frames written, want 200", frames)
+	}
+
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio := data[len(data)-200*format.BlockAlign():]
+	for i := range 200 {
+		want := []int16{8192, -8192}
+		if i >= 100 {
+			want = []int16{16384, -16384}
+		}
+		for c := range 2 {
+			if got := int16(binary.LittleEndian.Uint16(audio[(i*2+c)*2:])); got != want[c] {
+				t.Fatalf("frame %d channel %d: %d, want %d", i, c, got, want[c])
+			}
+		}
+	}
+}
+
+func TestStorageWorkerDatesTakeByFirstSample(t *testing.T) {
+	cfg := &config.Config{SampleRate: 48000, BufferSize: 4800, PreRollSeconds: 1}
+	state := &types.AppState{}
+	recordChan := make(chan []float32)
+	StartStorageWorker(state, cfg, recordChan, nil)
+
+	// 0.1 s of pre-roll, then a take whose metadata still has the time it
+	// was asked for, an hour ago
+	recordChan <- constChunk(4800, 0, 0)
+	format := types.WavFormat{Channels: 2, SampleRate: cfg.SampleRate, BitDepth: 16}
+	format.Bext = NewBextInfo("", "", "", time.Now().Add(-time.Hour), cfg.SampleRate)
+	file, _, _, err := CreateTake(filepath.Join(t.TempDir(), "rec"), 1, []int{0, 1}, false, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	state.Mu.Lock()
+	state.File, state.FileFormat, state.IsRecording, state.TakePart = file, format, true, 1
+	state.Mu.Unlock()
+
+	// The take starts 0.2 s before the second chunk arrives
+	before := time.Now().Add(-200 * time.Millisecond)
+	recordChan <- constChunk(4800, 0, 0)
+	recordChan <- nil
+	after := time.Now().Add(-200 * time.Millisecond)
+	// Later chunks leave it
+	recordChan <- constChunk(4800, 0, 0)
+	recordChan <- nil
+
+	state.Mu.Lock()
+	got := format.Bext.TimeReference
+	state.Mu.Unlock()
+	if got < timeReference(before, cfg.SampleRate) || got > timeReference(after, cfg.SampleRate) {
+		t.Errorf("time reference %d, want between %d and %d", got, timeReference(before, cfg.SampleRate), timeReference(after, cfg.SampleRate))
+	}
+}
@@ -0,0 +1,80 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/types"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PartName returns the file name base of part `part` (1 = first) of the take
+// named name: the name itself for the first part, then name_part002,
+// name_part003, ... for the parts of a take split by duration or size.
+func PartName(name string, part int) string {
+	if part <= 1 {
+		return name
+	}
+	return fmt.Sprintf("%s_part%03d", name, part)
+}
+
+// CreateTake creates the file(s) of one part of a take at path (the take
+// folder joined with the take name, without extension):
+//
+//	single file:  <path>.wav, then <path>_part002.wav, ...
+//	split tracks: <path>/<name>_chNN.wav, then <path>/<name>_part002_chNN.wav, ...
+//
+// WAV files start with a placeholder header; FLAC files are wrapped in
+// encoders, returned in the same order as the files.
+func CreateTake(path string, part int, channels []int, split bool, format types.WavFormat) (file *os.File, tracks []*os.File, encoders []types.Encoder, err error) {
+	name := PartName(filepath.Base(path), part)
+	if split {
+		tracks, err = CreateTrackFiles(path, name, channels, format)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, nil, nil, err
+		}
+		file, err = os.Create(filepath.Join(filepath.Dir(path), name+format.Extension()))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !format.Flac {
+			WritePlaceholderHeader(file, format)
+		}
+	}
+	if format.Flac {
+		encoders, err = NewFlacEncoders(file, tracks, format)
+		if err != nil {
+			for _, f := range append(tracks, file) {
+				if f != nil {
+					f.Close()
+					os.Remove(f.Name())
+				}
+			}
+			return nil, nil, nil, err
+		}
+	}
+	return file, tracks, encoders, nil
+}
+
+// FinalizeTake writes the final headers of the file(s) of a take (or of one
+// part of it) holding `samples` sample frames, and closes them.
+func FinalizeTake(file *os.File, tracks []*os.File, encoders []types.Encoder, format types.WavFormat, samples int64, cues []int64) error {
+	switch {
+	case len(encoders) > 0:
+		var firstErr error
+		for _, e := range encoders {
+			if err := e.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	case len(tracks) > 0:
+		FinalizeTrackFiles(tracks, format, samples, cues)
+	default:
+		FinalizeWavHeaderWithCues(file, format, samples, cues)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/types"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// CreateTrackFiles creates the files for a split-track take: one mono WAV per
+// recorded input channel inside dir, named <base>_chNN.wav (or .flac) after
+// the 1-based input number (input index 2 becomes "_ch03"). WAV tracks start
+// with a placeholder header in the take's format; FLAC tracks are left empty
+// for their encoders (see NewFlacEncoders). The returned slice is in recording channel order. If
+// any file can't be created, the ones created so far are removed.
+func CreateTrackFiles(dir, base string, channels []int, format types.WavFormat) ([]*os.File, error) {
+	format.Channels = 1
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files := make([]*os.File, 0, len(channels))
+	for _, c := range channels {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%s_ch%02d%s", base, c+1, format.Extension())))
+		if err != nil {
+			for _, created := range files {
+				created.Close()
+				os.Remove(created.Name())
+			}
+			return nil, err
+		}
+		if !format.Flac {
+			WritePlaceholderHeader(f, format)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// FinalizeTrackFiles writes the final header of every mono track of a
+// split-track take. All tracks hold the same number of samples, since the
+// storage worker writes them together, and the same cue markers.
+func FinalizeTrackFiles(files []*os.File, format types.WavFormat, samples int64, cues []int64) {
+	format.Channels = 1
+	for _, f := range files {
+		FinalizeWavHeaderWithCues(f, format, samples, cues)
+	}
+}
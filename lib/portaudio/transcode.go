@@ -0,0 +1,303 @@
+package portaudio
+
+import (
+	"behringerRecorder/lib/audiofile"
+	"behringerRecorder/lib/types"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// transcodeBlockFrames is the number of source frames processed per step of
+// a transcode; progress and cancellation are checked between steps.
+const transcodeBlockFrames = 8192
+
+// TranscodeOptions describe the output of Transcode. Zero values keep the
+// property of the source where that makes sense.
+type TranscodeOptions struct {
+	FileFormat string `json:"fileFormat"` // "wav" (default) or "flac"
+	BitDepth   string `json:"bitDepth"`   // "16", "24" or "32f"; empty keeps the source's, see SourceBitDepth
+	SampleRate int    `json:"sampleRate"` // 0 keeps the source rate
+	Mono       bool   `json:"mono"`       // downmix all channels to one
+	Dither     string `json:"dither"`     // dither for integer output, see ParseDither
+}
+
+// Validate checks the options without touching any file.
+func (o TranscodeOptions) Validate() error {
+	_, float, err := ParseBitDepth(o.BitDepth)
+	if err != nil {
+		return err
+	}
+	flac, err := ParseFileFormat(o.FileFormat)
+	if err != nil {
+		return err
+	}
+	if flac && float {
+		return fmt.Errorf("FLAC does not support 32-bit float")
+	}
+	if o.SampleRate < 0 || o.SampleRate > 384000 {
+		return fmt.Errorf("invalid sample rate %d", o.SampleRate)
+	}
+	_, err = ParseDither(o.Dither)
+	return err
+}
+
+// Transcode converts the recording src (WAV or FLAC) into dst with the given
+// options: downmix (average of all channels), then sample rate conversion,
+// then conversion to the output sample format. dst must not exist yet.
+// progress is called after every block with the fraction of src done [0.0
+// to 1.0]. When ctx is cancelled the partial dst is removed and ctx.Err()
+// is returned.
+func Transcode(ctx context.Context, src, dst string, opts TranscodeOptions, progress func(float64)) (err error) {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	in, err := audiofile.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info := in.Info()
+
+	flac, _ := ParseFileFormat(opts.FileFormat)
+	if opts.BitDepth == "" {
+		opts.BitDepth = SourceBitDepth(info, flac)
+	}
+	bits, float, _ := ParseBitDepth(opts.BitDepth)
+	dither, _ := ParseDither(opts.Dither)
+	format := types.WavFormat{
+		Channels:   info.Channels,
+		SampleRate: info.SampleRate,
+		BitDepth:   bits,
+		Float:      float,
+		Flac:       flac,
+	}
+	if opts.Mono {
+		format.Channels = 1
+	}
+	if opts.SampleRate > 0 {
+		format.SampleRate = opts.SampleRate
+	}
+
+	// Never overwrite: the file may be another job's output, or have been
+	// created while this job was queued
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	var enc *FlacEncoder
+	if flac {
+		if enc, err = NewFlacEncoder(out, format); err != nil {
+			out.Close()
+			os.Remove(dst)
+			return err
+		}
+	} else {
+		WritePlaceholderHeader(out, format)
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(dst)
+		}
+	}()
+
+	q := newQuantizer(dither)
+	var rs *resampler
+	if format.SampleRate != info.SampleRate {
+		rs = newResampler(info.SampleRate, format.SampleRate, format.Channels)
+	}
+	var frames int64
+	write := func(samples []float32) error {
+		if len(samples) == 0 {
+			return nil
+		}
+		frames += int64(len(samples) / format.Channels)
+		if enc != nil {
+			return enc.Write(quantizeSamples(format, samples, q))
+		}
+		_, err := out.Write(encodeSamples(format, samples, q))
+		return err
+	}
+
+	buf := make([]float32, transcodeBlockFrames*info.Channels)
+	var done int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, rerr := in.Read(buf)
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+		done += int64(n)
+		block := buf[:n*info.Channels]
+		if opts.Mono {
+			block = downmix(block, info.Channels)
+		}
+		if rs != nil {
+			block = rs.process(block)
+		}
+		if err := write(block); err != nil {
+			return err
+		}
+		if progress != nil && info.Frames > 0 {
+			progress(min(float64(done)/float64(info.Frames), 1))
+		}
+	}
+	if rs != nil {
+		if err := write(rs.flush()); err != nil {
+			return err
+		}
+	}
+
+	if enc != nil {
+		return enc.Close()
+	}
+	FinalizeWavHeader(out, format, frames)
+	return nil
+}
+
+// SourceBitDepth returns the output bit depth that keeps the samples of a
+// source with the given info: "16" up to 16 bits, "32f" for float sources
+// (or "24" for FLAC output, which has no float), else "24".
+func SourceBitDepth(info audiofile.Info, flac bool) string {
+	switch {
+	case info.Float && !flac:
+		return "32f"
+	case info.BitDepth <= 16 && !info.Float:
+		return "16"
+	}
+	return "24"
+}
+
+// downmix averages the channels of every interleaved frame into one.
+func downmix(samples []float32, channels int) []float32 {
+	if channels == 1 {
+		return samples
+	}
+	out := make([]float32, len(samples)/channels)
+	for i := range out {
+		var sum float32
+		for _, s := range samples[i*channels : (i+1)*channels] {
+			sum += s
+		}
+		out[i] = sum / float32(channels)
+	}
+	return out
+}
+
+// resamplerZeroCrossings is the number of zero crossings of the sinc kernel
+// on each side, and resamplerPhases the resolution of the kernel table per
+// input sample (values in between are interpolated linearly).
+const (
+	resamplerZeroCrossings = 16
+	resamplerPhases        = 512
+)
+
+// resampler converts interleaved audio between sample rates by band-limited
+// interpolation with a Blackman windowed sinc kernel. Output sample k is
+// centered on input position k * inRate/outRate:
+//
+//	y[k] = sum over n of x[n] * h(k*inRate/outRate - n)
+//	h(t) = c * sinc(c*t) * blackman(t / width),  c = min(1, outRate/inRate) * 0.95
+//
+// When downsampling the cutoff c is lowered to just below the new Nyquist
+// frequency (and the kernel widened to match), so content above it is
+// filtered out instead of aliasing.
+type resampler struct {
+	channels int
+	step     float64 // input samples per output sample
+	width    float64 // kernel half width in input samples
+	table    []float64
+	tableRes float64 // table entries per input sample
+	buf      []float32
+	pos      float64 // position of the next output sample in buf, in frames
+
+	inFrames  int64 // input frames processed
+	outFrames int64 // output frames produced
+}
+
+func newResampler(inRate, outRate, channels int) *resampler {
+	c := math.Min(1, float64(outRate)/float64(inRate)) * 0.95
+	width := resamplerZeroCrossings / c
+	r := &resampler{
+		channels: channels,
+		step:     float64(inRate) / float64(outRate),
+		width:    width,
+		tableRes: resamplerPhases,
+	}
+	r.table = make([]float64, int(width*resamplerPhases)+2)
+	for i := range r.table {
+		t := float64(i) / resamplerPhases
+		if t >= width {
+			continue
+		}
+		sinc := 1.0
+		if t > 0 {
+			sinc = math.Sin(math.Pi*c*t) / (math.Pi * c * t)
+		}
+		x := 0.5 + 0.5*t/width // 0.5 at the center, 1 at the edge
+		window := 0.42 - 0.5*math.Cos(2*math.Pi*x) + 0.08*math.Cos(4*math.Pi*x)
+		r.table[i] = c * sinc * window
+	}
+	// Start with `width` frames of silence, so the first output sample can
+	// look back as far as it looks ahead.
+	r.buf = make([]float32, int(math.Ceil(width))*channels)
+	r.pos = math.Ceil(width)
+	return r
+}
+
+// kernel returns h(t) from the table.
+func (r *resampler) kernel(t float64) float64 {
+	t = math.Abs(t) * r.tableRes
+	i := int(t)
+	if i+1 >= len(r.table) {
+		return 0
+	}
+	f := t - float64(i)
+	return r.table[i]*(1-f) + r.table[i+1]*f
+}
+
+// process appends interleaved input and returns all output samples whose
+// kernel window is complete.
+func (r *resampler) process(in []float32) []float32 {
+	r.buf = append(r.buf, in...)
+	r.inFrames += int64(len(in) / r.channels)
+	frames := len(r.buf) / r.channels
+	var out []float32
+	for r.pos+r.width < float64(frames) {
+		first := int(math.Ceil(r.pos - r.width))
+		last := int(math.Floor(r.pos + r.width))
+		for c := 0; c < r.channels; c++ {
+			var sum float64
+			for n := max(first, 0); n <= last; n++ {
+				sum += float64(r.buf[n*r.channels+c]) * r.kernel(r.pos-float64(n))
+			}
+			out = append(out, float32(sum))
+		}
+		r.pos += r.step
+		r.outFrames++
+	}
+	// Drop input no longer needed by the next output sample
+	drop := max(int(r.pos-r.width)-1, 0)
+	r.buf = r.buf[drop*r.channels:]
+	r.pos -= float64(drop)
+	return out
+}
+
+// flush feeds silence to emit the output samples covering the end of the
+// input: ceil(input frames * outRate/inRate) output frames in total.
+func (r *resampler) flush() []float32 {
+	want := int64(math.Ceil(float64(r.inFrames)/r.step)) - r.outFrames
+	out := r.process(make([]float32, (int(math.Ceil(r.width))+2)*r.channels))
+	if n := int(max(want, 0)) * r.channels; n < len(out) {
+		out = out[:n]
+	}
+	return out
+}
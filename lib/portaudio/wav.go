@@ -1,67 +1,302 @@
 package portaudio
 
 import (
+	"behringerRecorder/lib/types"
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"os"
 )
 
-// WritePlaceholderHeader writes a 44-byte placeholder WAV header at the start of the file.
+// Header sizes. Takes are written with a header that reserves room for a
+// ds64 chunk (as a JUNK chunk) so a take can turn into RF64 once it grows
+// past 4 GB; for 16-bit PCM without bext metadata it is 80 bytes. The 44-byte
+// layout without it is what older versions of the recorder wrote;
+// RepairWavFiles still understands their all-zero placeholder.
+const (
+	wavHeaderSize    = 80
+	legacyHeaderSize = 44
+
+	// Largest size a plain RIFF file can describe in its 32-bit size fields
+	maxRiffSize = 0xFFFFFFFF
+)
+
+// Format tags used in the fmt chunk.
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatIEEEFloat  = 0x0003
+	wavFormatExtensible = 0xFFFE
+)
+
+// ParseBitDepth parses the `bit_depth` setting: "16", "24" or "32f" (32-bit
+// float). An empty string means 16-bit.
+func ParseBitDepth(s string) (bits int, float bool, err error) {
+	switch s {
+	case "", "16":
+		return 16, false, nil
+	case "24":
+		return 24, false, nil
+	case "32f":
+		return 32, true, nil
+	}
+	return 0, false, fmt.Errorf("unsupported bit depth %q (use 16, 24 or 32f)", s)
+}
+
+// WritePlaceholderHeader writes a placeholder WAV header at the start of the file.
 // This is done because the WAV header contains the total file size and data size,
 // which are unknown until recording finishes. By writing a placeholder first,
 // we reserve space and can seek back to fill in the correct values later.
-// WAV header structure is always 44 bytes for standard PCM audio:
+// The placeholder already carries the real format (channels, sample rate,
+// sample format) with zero sizes, so a take interrupted by a crash can be
+// repaired from its length (see RepairWavFiles).
+// WAV header structure for our audio:
 //   - RIFF header (12 bytes)
-//   - fmt chunk (24 bytes)
+//   - JUNK chunk (36 bytes), becomes the ds64 chunk for RF64
+//   - bext chunk (Broadcast Wave takes only)
+//   - fmt chunk (24, 26 or 48 bytes depending on the sample format)
+//   - fact chunk (12 bytes, float takes only)
 //   - data chunk header (8 bytes)
-func WritePlaceholderHeader(f *os.File) {
+func WritePlaceholderHeader(f *os.File, format types.WavFormat) {
 	if f == nil {
 		return
 	}
 	f.Seek(0, 0)
-	f.Write(make([]byte, 44))
+	f.Write(wavHeader(format, 0, 0, true))
+}
+
+// UpdateWavHeader rewrites the header of a take that is still being recorded
+// with the current sample count and flushes the file to disk. It doesn't move
+// the write offset, so the storage worker keeps appending where it was.
+func UpdateWavHeader(f *os.File, format types.WavFormat, s int64) error {
+	if f == nil {
+		return nil
+	}
+	if _, err := f.WriteAt(wavHeader(format, s, 0, true), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func FinalizeWavHeader(f *os.File, format types.WavFormat, s int64) {
+	FinalizeWavHeaderWithCues(f, format, s, nil)
 }
 
-func FinalizeWavHeader(f *os.File, ch uint16, s int64, sampleRate int) {
+// FinalizeWavHeaderWithCues is FinalizeWavHeader for takes with cue markers
+// (e.g. resume points of a paused take). cues are sample frame positions;
+// they are appended as a "cue " chunk after the audio data.
+func FinalizeWavHeaderWithCues(f *os.File, format types.WavFormat, s int64, cues []int64) {
 	if f == nil {
 		return
 	}
+	header := wavHeader(format, s, 0, true)
+	dataEnd := int64(len(header)) + s*int64(format.BlockAlign())
+
+	// Chunks after the audio data count towards the RIFF size. RIFF chunks
+	// are word aligned, so odd-sized data (e.g. 24-bit mono with an odd
+	// number of frames) is followed by a pad byte.
+	var trailing int64
+	if dataEnd%2 == 1 {
+		f.WriteAt([]byte{0}, dataEnd)
+		trailing = 1
+	}
+	if len(cues) > 0 {
+		trailing += writeCueChunk(f, dataEnd+trailing, cues)
+	}
+	if trailing > 0 {
+		header = wavHeader(format, s, trailing, true)
+	}
+
+	f.WriteAt(header, 0)
+	f.Close()
+}
+
+// wavHeader builds the header for `s` sample frames, followed by `trailing`
+// bytes of chunks after the audio data. With reserveDs64 set it is the
+// current layout, which switches from RIFF to RF64 when the sizes no longer
+// fit in 32 bits; otherwise it is the legacy 44-byte RIFF layout (16-bit PCM
+// only).
+func wavHeader(format types.WavFormat, s int64, trailing int64, reserveDs64 bool) []byte {
 	// Calculate sizes in bytes
-	// Each sample is int16 (2 bytes), stereo has 2 channels
-	dataSize := uint32(s * int64(ch) * 2)                   // Total audio data in bytes
-	byteRate := uint32(uint32(sampleRate) * uint32(ch) * 2) // Bytes per second (SampleRate * Channels * 2)
-	blockAlign := uint16(ch * 2)                            // Bytes per sample frame (Channels * 2)
+	dataSize := s * int64(format.BlockAlign()) // Total audio data in bytes
+
+	var bext, fmtChunk, fact []byte
+	if reserveDs64 {
+		if format.Bext != nil {
+			bext = bextChunk(format)
+		}
+		fmtChunk = formatChunk(format)
+		if format.Float {
+			// Non-PCM formats carry the sample frame count in a fact chunk
+			fact = make([]byte, 12)
+			copy(fact, "fact")
+			binary.LittleEndian.PutUint32(fact[4:], 4)
+			binary.LittleEndian.PutUint32(fact[8:], uint32(min(s, maxRiffSize)))
+		}
+	} else {
+		fmtChunk = formatChunk(types.WavFormat{Channels: format.Channels, SampleRate: format.SampleRate, BitDepth: 16})
+	}
+
+	headerSize := int64(12 + len(fmtChunk) + len(fact) + 8)
+	if reserveDs64 {
+		headerSize += 36 + int64(len(bext))
+	}
+	riffSize := headerSize - 8 + dataSize + trailing // File size minus the RIFF chunk header
+	rf64 := reserveDs64 && (riffSize > maxRiffSize || dataSize > maxRiffSize)
 
-	// Seek to start and write the complete WAV header
 	// WAV File Format (Little Endian):
 	//   Offset  Size  Field          Description
 	//   ------  ----  -----          -----------
-	//   0       4     "RIFF"         Chunk ID (marks this as RIFF file)
-	//   4       4     FileSize-8     File size minus 8 bytes (for RIFF header itself)
+	//   0       4     "RIFF"         Chunk ID (marks this as RIFF file), "RF64" for RF64
+	//   4       4     FileSize-8     File size minus 8 bytes (for RIFF header itself), 0xFFFFFFFF for RF64
 	//   8       4     "WAVE"         Format identifier (always "WAVE" for audio)
-	//   12      4     "fmt "         Subchunk1 ID (format chunk, note the space)
-	//   16      4     16             Subchunk1 Size (16 bytes for PCM)
-	//   20      2     1              Audio Format (1 = PCM, others = compressed)
-	//   22      2     Channels       Number of audio channels (1=mono, 2=stereo)
-	//   24      4     SampleRate     Sample rate in Hz (e.g., 48000, 44100)
-	//   28      4     ByteRate       SampleRate * Channels * BytesPerSample
-	//   32      2     BlockAlign     Channels * BytesPerSample (frame size)
-	//   34      2     BitsPerSample  Bits per sample (16 for int16)
-	//   36      4     "data"         Data chunk ID (marks audio data section)
-	//   40      4     DataSize       Number of bytes of audio data
-	//   44      ...   Audio Data     Raw PCM samples follow
-	f.Seek(0, 0)
-	f.Write([]byte{'R', 'I', 'F', 'F'})
-	binary.Write(f, binary.LittleEndian, uint32(36+dataSize))
-	f.Write([]byte{'W', 'A', 'V', 'E'})
-	f.Write([]byte{'f', 'm', 't', ' '})
-	binary.Write(f, binary.LittleEndian, uint32(16))
-	binary.Write(f, binary.LittleEndian, uint16(1)) // PCM format
-	binary.Write(f, binary.LittleEndian, ch)
-	binary.Write(f, binary.LittleEndian, uint32(sampleRate))
-	binary.Write(f, binary.LittleEndian, byteRate)
-	binary.Write(f, binary.LittleEndian, blockAlign)
-	binary.Write(f, binary.LittleEndian, uint16(16)) // 16-bit samples
-	f.Write([]byte{'d', 'a', 't', 'a'})
-	binary.Write(f, binary.LittleEndian, dataSize)
-	f.Close()
+	//   12      4     "JUNK"         Reserved chunk ID, "ds64" for RF64
+	//   16      4     28             Reserved chunk size
+	//   20      8     RiffSize       RF64 only: 64-bit FileSize-8
+	//   28      8     DataSize       RF64 only: 64-bit DataSize
+	//   36      8     SampleCount    RF64 only: 64-bit number of sample frames
+	//   44      4     0              RF64 only: table length (no extra sizes)
+	//   48      ...   "bext" chunk   Broadcast Wave metadata, if enabled (see bextChunk)
+	//   ...     ...   "fmt " chunk   Sample format (see formatChunk)
+	//   ...     12    "fact" chunk   Float takes only: 32-bit number of sample frames
+	//   ...     4     "data"         Data chunk ID (marks audio data section)
+	//   ...     4     DataSize       Number of bytes of audio data, 0xFFFFFFFF for RF64
+	//   ...     ...   Audio Data     Raw samples follow, interleaved by frame
+	//
+	// The legacy layout is RIFF header, 16-bit PCM fmt chunk and data
+	// header only, so "fmt " starts at 12 and the audio data at 44.
+	var b bytes.Buffer
+	if rf64 {
+		b.Write([]byte{'R', 'F', '6', '4'})
+		binary.Write(&b, binary.LittleEndian, uint32(maxRiffSize))
+	} else {
+		b.Write([]byte{'R', 'I', 'F', 'F'})
+		binary.Write(&b, binary.LittleEndian, uint32(riffSize))
+	}
+	b.Write([]byte{'W', 'A', 'V', 'E'})
+	if reserveDs64 {
+		if rf64 {
+			b.Write([]byte{'d', 's', '6', '4'})
+		} else {
+			b.Write([]byte{'J', 'U', 'N', 'K'})
+		}
+		binary.Write(&b, binary.LittleEndian, uint32(28))
+		if rf64 {
+			binary.Write(&b, binary.LittleEndian, uint64(riffSize))
+			binary.Write(&b, binary.LittleEndian, uint64(dataSize))
+			binary.Write(&b, binary.LittleEndian, uint64(s))
+			binary.Write(&b, binary.LittleEndian, uint32(0))
+		} else {
+			b.Write(make([]byte, 28))
+		}
+		b.Write(bext)
+	}
+	b.Write(fmtChunk)
+	b.Write(fact)
+	b.Write([]byte{'d', 'a', 't', 'a'})
+	if rf64 {
+		binary.Write(&b, binary.LittleEndian, uint32(maxRiffSize))
+	} else {
+		binary.Write(&b, binary.LittleEndian, uint32(dataSize))
+	}
+	return b.Bytes()
+}
+
+// formatChunk builds the "fmt " chunk, including its chunk header.
+//
+// Plain 16-bit PCM with up to two channels uses the classic 16-byte PCM
+// format; float with up to two channels uses WAVE_FORMAT_IEEE_FLOAT. Deeper
+// integer samples and more than two channels need WAVE_FORMAT_EXTENSIBLE,
+// which carries the real format as a SubFormat GUID.
+//
+// Fmt Chunk Format (Little Endian):
+//
+//	Offset  Size  Field          Description
+//	------  ----  -----          -----------
+//	0       4     "fmt "         Chunk ID (note the space)
+//	4       4     16 / 18 / 40   Chunk size
+//	8       2     FormatTag      1 = PCM, 3 = IEEE float, 0xFFFE = extensible
+//	10      2     Channels       Number of audio channels (1=mono, 2=stereo)
+//	12      4     SampleRate     Sample rate in Hz (e.g., 48000, 44100)
+//	16      4     ByteRate       SampleRate * Channels * BytesPerSample
+//	20      2     BlockAlign     Channels * BytesPerSample (frame size)
+//	22      2     BitsPerSample  Bits per sample (16, 24 or 32)
+//	24      2     cbSize         Float: 0, extensible: 22 (absent for PCM)
+//	26      2     ValidBits      Extensible only: bits of precision
+//	28      4     ChannelMask    Extensible only: speaker positions (0 for >2 independent inputs)
+//	32      16    SubFormat      Extensible only: GUID starting with the real format tag
+func formatChunk(format types.WavFormat) []byte {
+	ch := format.Channels
+	byteRate := uint32(format.SampleRate * format.BlockAlign()) // Bytes per second
+
+	tag := uint16(wavFormatPCM)
+	if format.Float {
+		tag = wavFormatIEEEFloat
+	}
+	extensible := ch > 2 || (!format.Float && format.BitDepth > 16)
+
+	size := 16
+	switch {
+	case extensible:
+		size = 40
+	case format.Float:
+		size = 18
+	}
+	buf := make([]byte, 8+size)
+	copy(buf[0:], "fmt ")
+	binary.LittleEndian.PutUint32(buf[4:], uint32(size))
+	if extensible {
+		binary.LittleEndian.PutUint16(buf[8:], wavFormatExtensible)
+	} else {
+		binary.LittleEndian.PutUint16(buf[8:], tag)
+	}
+	binary.LittleEndian.PutUint16(buf[10:], uint16(ch))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(format.SampleRate))
+	binary.LittleEndian.PutUint32(buf[16:], byteRate)
+	binary.LittleEndian.PutUint16(buf[20:], uint16(format.BlockAlign()))
+	binary.LittleEndian.PutUint16(buf[22:], uint16(format.BitDepth))
+	if extensible {
+		var mask uint32
+		switch ch {
+		case 1:
+			mask = 0x4 // Front center
+		case 2:
+			mask = 0x3 // Front left | front right
+		}
+		binary.LittleEndian.PutUint16(buf[24:], 22)
+		binary.LittleEndian.PutUint16(buf[26:], uint16(format.BitDepth))
+		binary.LittleEndian.PutUint32(buf[28:], mask)
+		// KSDATAFORMAT_SUBTYPE_PCM / _IEEE_FLOAT:
+		// {0000000X-0000-0010-8000-00AA00389B71}
+		binary.LittleEndian.PutUint16(buf[32:], tag)
+		copy(buf[38:], []byte{0x10, 0x00, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71})
+	}
+	return buf
+}
+
+// writeCueChunk writes a "cue " chunk at offset (the end of the audio data)
+// and returns its size in bytes, including the chunk header.
+//
+// Cue Chunk Format (Little Endian):
+//
+//	Offset  Size  Field          Description
+//	------  ----  -----          -----------
+//	0       4     "cue "         Chunk ID
+//	4       4     4+24*N         Chunk size
+//	8       4     N              Number of cue points
+//	12+     24*N  Cue points     ID, Position, "data", ChunkStart, BlockStart, SampleOffset
+func writeCueChunk(f *os.File, offset int64, cues []int64) int64 {
+	size := 4 + 24*len(cues)
+	buf := make([]byte, 8+size)
+	copy(buf[0:], "cue ")
+	binary.LittleEndian.PutUint32(buf[4:], uint32(size))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(cues)))
+	for i, pos := range cues {
+		p := buf[12+i*24:]
+		binary.LittleEndian.PutUint32(p[0:], uint32(i+1))  // Cue point ID
+		binary.LittleEndian.PutUint32(p[4:], uint32(pos))  // Play order position
+		copy(p[8:], "data")                                // Chunk the cue refers to
+		binary.LittleEndian.PutUint32(p[20:], uint32(pos)) // Sample offset within data
+	}
+	f.WriteAt(buf, offset)
+	return int64(len(buf))
 }
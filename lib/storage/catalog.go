@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for recordings and trash entries that don't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrExists is returned when a rename or restore would replace a file.
+	ErrExists = errors.New("already exists")
+)
+
+// catalogFile holds the index of all recordings, in the store folder.
+const catalogFile = ".recordings.json"
+
+// Metadata is what the user attached to a recording.
+type Metadata struct {
+	Title string   `json:"title,omitempty"`
+	Notes string   `json:"notes,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// IsZero reports whether nothing is attached.
+func (m Metadata) IsZero() bool {
+	return m.Title == "" && m.Notes == "" && len(m.Tags) == 0
+}
+
+// normalizeTags trims the tags and drops empty and repeated ones, keeping
+// the order.
+func normalizeTags(tags []string) []string {
+	var out []string
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		if t != "" && !slices.Contains(out, t) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// Origin tells how a recording was made. It is known for takes recorded by
+// this app; for files found by a rescan only Recorded is set, estimated from
+// the modification time and duration.
+type Origin struct {
+	Recorded time.Time `json:"recorded"` // Start of the recording
+	Device   string    `json:"device,omitempty"`
+	Session  string    `json:"session,omitempty"`
+	Take     int       `json:"take,omitempty"`
+}
+
+// Recording is the index entry of one recording file. The file fields are
+// refreshed whenever its size or modification time changes.
+type Recording struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+	Format     string    `json:"format,omitempty"` // "wav" or "flac"
+	Channels   int       `json:"channels,omitempty"`
+	SampleRate int       `json:"sampleRate,omitempty"`
+	BitDepth   string    `json:"bitDepth,omitempty"` // "16", "24" or "32f"
+	Duration   float64   `json:"duration"`           // Seconds
+	Peak       *float64  `json:"peak,omitempty"`     // Highest absolute sample value, 1.0 = full scale
+	Loudness   *Loudness `json:"loudness,omitempty"`
+	InProgress bool      `json:"inProgress,omitempty"`
+	Error      string    `json:"error,omitempty"` // Why the file couldn't be read
+	Origin
+	Metadata
+}
+
+// Catalog is the persistent index of the recordings of a store. Besides
+// what the file headers say it keeps what the files can't tell: how the
+// take was made and what the user attached. It also renames recordings and
+// deletes them to the trash, keeping the index in step. The index is one
+// JSON file keyed by recording name:
+//
+//	{"Band rehearsal/rec_1700000000.wav": {"name": "...", "duration": 12.5,
+//	 "session": "Band rehearsal", "title": "Intro", "tags": ["keep"], ...}}
+//
+// All changes go through one mutex, so concurrent requests can't interleave
+// a rename with a delete of the same file. Files are read outside the lock.
+type Catalog struct {
+	store *Store
+
+	mu   sync.Mutex
+	recs map[string]Recording
+
+	scanMu sync.Mutex // One rescan at a time
+}
+
+// OpenCatalog loads the index of the store. A missing file starts empty; an
+// unreadable one is reported but also starts empty, so recording still
+// works. Call Rescan to bring the index up to date with the files.
+func OpenCatalog(store *Store) (*Catalog, error) {
+	c := &Catalog{store: store, recs: map[string]Recording{}}
+	path := filepath.Join(store.Dir(), catalogFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c.recs); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	for name, rec := range c.recs {
+		rec.Name = name
+		rec.InProgress = false // Left over from a crash; the rescan reads it
+		c.recs[name] = rec
+	}
+	return c, nil
+}
+
+// Store returns the store of the catalog.
+func (c *Catalog) Store() *Store {
+	return c.store
+}
+
+// Get returns the index entry of recording name.
+func (c *Catalog) Get(name string) (Recording, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rec, ok := c.recs[name]
+	return rec, ok
+}
+
+// SetMetadata replaces the metadata of the existing recording name.
+func (c *Catalog) SetMetadata(name string, m Metadata) error {
+	path, err := c.recording(name)
+	if err != nil {
+		return err
+	}
+	name, _ = c.store.Rel(path)
+	m.Tags = normalizeTags(m.Tags)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rec, ok := c.recs[name]
+	if !ok {
+		rec = Recording{Name: name, Format: formatOf(name)}
+	}
+	rec.Metadata = m
+	c.recs[name] = rec
+	return c.saveLocked()
+}
+
+// Rename moves recording from to the name to, creating folders as needed,
+// and moves its index entry along. The extension can't change, and an
+// existing file is never replaced.
+func (c *Catalog) Rename(from, to string) error {
+	src, err := c.recording(from)
+	if err != nil {
+		return err
+	}
+	dst, err := c.store.Path(to)
+	if err != nil {
+		return err
+	}
+	if filepath.Ext(dst) != filepath.Ext(src) {
+		return fmt.Errorf("%w: %q must keep the extension %s", ErrInvalidPath, to, filepath.Ext(src))
+	}
+	from, _ = c.store.Rel(src)
+	to, _ = c.store.Rel(dst)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := moveFile(src, dst); err != nil {
+		return err
+	}
+	removeEmptyDirs(c.store.Dir(), filepath.Dir(src))
+	if moveFile(c.peaksPath(from), c.peaksPath(to)) == nil {
+		removeEmptyDirs(filepath.Join(c.store.Dir(), peaksDir), filepath.Dir(c.peaksPath(from)))
+	}
+	if rec, ok := c.recs[from]; ok {
+		delete(c.recs, from)
+		rec.Name = to
+		c.recs[to] = rec
+	}
+	return c.saveLocked()
+}
+
+// recording resolves name and checks that it is an existing recording.
+func (c *Catalog) recording(name string) (string, error) {
+	path, err := c.store.Path(name)
+	if err != nil {
+		return "", err
+	}
+	if formatOf(path) == "" {
+		return "", fmt.Errorf("%w: %q is not a recording", ErrInvalidPath, name)
+	}
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("recording %q %w", name, ErrNotFound)
+	}
+	return path, nil
+}
+
+// formatOf returns the file format of a recording by its extension, or ""
+// for other files.
+func formatOf(name string) string {
+	switch filepath.Ext(name) {
+	case ".wav":
+		return "wav"
+	case ".flac":
+		return "flac"
+	}
+	return ""
+}
+
+// saveLocked writes the index. Callers must hold c.mu.
+func (c *Catalog) saveLocked() error {
+	data, err := json.MarshalIndent(c.recs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(c.store.Dir(), catalogFile), data)
+}
+
+// moveFile renames src to dst, creating the folder of dst, but fails with
+// ErrExists instead of replacing dst.
+func moveFile(src, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s %w", filepath.Base(dst), ErrExists)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+// removeEmptyDirs removes dir and its parents up to (not including) root as
+// long as they are empty, so moving the last track out of a take folder
+// doesn't leave the folder behind.
+func removeEmptyDirs(root, dir string) {
+	for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// WriteFileAtomic writes data to a temporary file and renames it over path,
+// so a crash can't leave a truncated file.
+func WriteFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,371 @@
+package storage
+
+import (
+	"behringerRecorder/lib/audiofile"
+	"behringerRecorder/lib/loudness"
+	"cmp"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query selects, orders and pages recordings for Find.
+type Query struct {
+	Search   string    // Case-insensitive text in the name, title, notes, tags, session or device
+	Tags     []string  // Recordings having all of these tags
+	Session  string    // Recordings of this session
+	Format   string    // "wav" or "flac"
+	From, To time.Time // Recorded within [From, To); zero leaves that end open
+	Sort     string    // "name" (default), "recorded", "size", "duration" or "peak"
+	Desc     bool      // Sort descending
+	Offset   int       // Recordings to skip
+	Limit    int       // Recordings to return at most; 0 for all
+}
+
+// sortKeys are the orders Find supports. Ties are broken by name.
+var sortKeys = map[string]func(a, b Recording) int{
+	"name":     func(a, b Recording) int { return 0 },
+	"recorded": func(a, b Recording) int { return a.Recorded.Compare(b.Recorded) },
+	"size":     func(a, b Recording) int { return cmp.Compare(a.Size, b.Size) },
+	"duration": func(a, b Recording) int { return cmp.Compare(a.Duration, b.Duration) },
+	"peak": func(a, b Recording) int {
+		peak := func(r Recording) float64 {
+			if r.Peak == nil {
+				return -1
+			}
+			return *r.Peak
+		}
+		return cmp.Compare(peak(a), peak(b))
+	},
+}
+
+// Find returns one page of the recordings matching q and the number of all
+// matching recordings.
+func (c *Catalog) Find(q Query) ([]Recording, int, error) {
+	byKey := sortKeys["name"]
+	if q.Sort != "" {
+		var ok bool
+		if byKey, ok = sortKeys[q.Sort]; !ok {
+			return nil, 0, fmt.Errorf("invalid sort %q", q.Sort)
+		}
+	}
+	search := strings.ToLower(q.Search)
+
+	c.mu.Lock()
+	var list []Recording
+	for _, rec := range c.recs {
+		if q.Session != "" && rec.Session != q.Session ||
+			q.Format != "" && rec.Format != q.Format ||
+			!q.From.IsZero() && rec.Recorded.Before(q.From) ||
+			!q.To.IsZero() && !rec.Recorded.Before(q.To) {
+			continue
+		}
+		if !slices.ContainsFunc(q.Tags, func(t string) bool { return !slices.Contains(rec.Tags, t) }) &&
+			(search == "" || rec.matches(search)) {
+			list = append(list, rec)
+		}
+	}
+	c.mu.Unlock()
+
+	slices.SortFunc(list, func(a, b Recording) int {
+		order := cmp.Or(byKey(a, b), strings.Compare(a.Name, b.Name))
+		if q.Desc {
+			return -order
+		}
+		return order
+	})
+	total := len(list)
+	list = list[min(max(q.Offset, 0), total):]
+	if q.Limit > 0 && q.Limit < len(list) {
+		list = list[:q.Limit]
+	}
+	return list, total, nil
+}
+
+// matches reports whether the lower-case text occurs in the searchable
+// fields of the recording.
+func (r Recording) matches(text string) bool {
+	fields := append([]string{r.Name, r.Title, r.Notes, r.Session, r.Device}, r.Tags...)
+	for _, f := range fields {
+		if strings.Contains(strings.ToLower(f), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// Begin adds the files of a take (or part) that starts recording, given as
+// absolute paths, with the origin and metadata known at the start. They are
+// listed as in progress until Finish.
+func (c *Catalog) Begin(paths []string, origin Origin, m Metadata) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, path := range paths {
+		name, err := c.store.Rel(path)
+		if err != nil {
+			continue
+		}
+		c.recs[name] = Recording{
+			Name:       name,
+			Format:     formatOf(name),
+			InProgress: true,
+			Origin:     origin,
+			Metadata:   m,
+		}
+	}
+	if err := c.saveLocked(); err != nil {
+		fmt.Printf("[FILES] Could not save the index: %v\n", err)
+	}
+}
+
+// Finish reads the files of a take (or part) that ended, given as absolute
+// paths, into the index and writes their peak files. It reads them through,
+// so callers that can't wait should run it in a goroutine.
+func (c *Catalog) Finish(paths []string) {
+	c.refresh(paths)
+	for _, path := range paths {
+		name, _ := c.store.Rel(path)
+		if rec, ok := c.Get(name); ok && rec.Loudness != nil {
+			fmt.Printf("[FILES] Loudness of %s: %v\n", name, rec.Loudness)
+		}
+	}
+}
+
+// Add indexes files the app made outside of a take, such as transcode
+// outputs, given as absolute paths, with the origin and metadata to keep
+// (e.g. those of the source). Like Finish it reads them through.
+func (c *Catalog) Add(paths []string, origin Origin, m Metadata) {
+	c.mu.Lock()
+	for _, path := range paths {
+		if name, err := c.store.Rel(path); err == nil {
+			c.recs[name] = Recording{Name: name, Format: formatOf(name), Origin: origin, Metadata: m}
+		}
+	}
+	c.mu.Unlock()
+	c.refresh(paths)
+}
+
+// Rescan brings the index up to date with the files in the store: files
+// added, changed or removed behind the app's back (or while it wasn't
+// running) are read, refreshed or dropped, and entries indexed before
+// loudness was measured are read again. Files still being recorded are left
+// alone. Only changed files are read, but the first scan of a large storage
+// reads everything, so it is best run in a goroutine.
+func (c *Catalog) Rescan() error {
+	c.scanMu.Lock()
+	defer c.scanMu.Unlock()
+	stale, err := c.scan()
+	c.refresh(stale)
+	return err
+}
+
+// Sync is the quick Rescan run before listing: it only walks the store, so
+// new files are listed at once and removed ones are dropped, and reads the
+// new and changed files in the background. While a rescan is running it
+// does nothing.
+func (c *Catalog) Sync() error {
+	if !c.scanMu.TryLock() {
+		return nil
+	}
+	stale, err := c.scan()
+	go func() {
+		defer c.scanMu.Unlock()
+		c.refresh(stale)
+	}()
+	return err
+}
+
+// scan compares the files in the store with the index: new files get an
+// entry, entries of removed files are dropped, and the paths of the new and
+// changed files are returned for refresh. Callers must hold c.scanMu.
+func (c *Catalog) scan() ([]string, error) {
+	// An unmounted or missing storage must not drop the whole index
+	if _, err := os.Stat(c.store.Dir()); err != nil {
+		return nil, err
+	}
+
+	type file struct {
+		path string
+		info fs.FileInfo
+	}
+	found := map[string]file{}
+	filepath.WalkDir(c.store.Dir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == c.store.Dir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || formatOf(path) == "" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if name, err := c.store.Rel(path); err == nil {
+			found[name] = file{path, info}
+		}
+		return nil
+	})
+
+	c.mu.Lock()
+	var stale []string
+	removed := false
+	for name, rec := range c.recs {
+		if rec.InProgress {
+			continue
+		}
+		f, ok := found[name]
+		if !ok {
+			delete(c.recs, name)
+			c.removePeaks(name)
+			removed = true
+		} else if rec.Size != f.info.Size() || !rec.ModTime.Equal(f.info.ModTime()) {
+			stale = append(stale, f.path)
+		}
+	}
+	for name, f := range found {
+		if _, ok := c.recs[name]; !ok {
+			c.recs[name] = Recording{Name: name, Format: formatOf(name)}
+			stale = append(stale, f.path)
+		}
+	}
+	var err error
+	if removed || len(stale) > 0 {
+		err = c.saveLocked()
+	}
+	c.mu.Unlock()
+	return stale, err
+}
+
+// refresh reads the given files (absolute paths), updates their index
+// entries, keeping the origin and metadata, and writes their peak files. The
+// files are read without holding the lock; an entry renamed, deleted or
+// changed meanwhile is left for the next rescan.
+func (c *Catalog) refresh(paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	for _, path := range paths {
+		name, err := c.store.Rel(path)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		rec, peaks := probe(path, info)
+
+		c.mu.Lock()
+		cur, ok := c.recs[name]
+		if now, err := os.Stat(path); ok && err == nil && now.Size() == info.Size() && now.ModTime().Equal(info.ModTime()) {
+			rec.Name = name
+			rec.Origin = cur.Origin
+			rec.Metadata = cur.Metadata
+			if rec.Recorded.IsZero() {
+				rec.Recorded = rec.ModTime.Add(-time.Duration(rec.Duration * float64(time.Second)))
+			}
+			c.recs[name] = rec
+		} else {
+			peaks = nil
+		}
+		c.mu.Unlock()
+		if peaks != nil {
+			if err := writePeaks(c.peaksPath(name), info, peaks); err != nil {
+				fmt.Printf("[FILES] Could not save the peaks of %s: %v\n", name, err)
+			}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.saveLocked(); err != nil {
+		fmt.Printf("[FILES] Could not save the index: %v\n", err)
+	}
+}
+
+// probe reads the file fields of an index entry and the waveform peaks
+// from the file. The audio is decoded through to measure the peak level and
+// loudness.
+func probe(path string, info fs.FileInfo) (Recording, *audiofile.Peaks) {
+	rec := Recording{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Format:  formatOf(path),
+	}
+	a, err := decode(path, true)
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if a.peaks == nil {
+		return rec, nil
+	}
+	rec.Channels = a.info.Channels
+	rec.SampleRate = a.info.SampleRate
+	rec.BitDepth = strconv.Itoa(a.info.BitDepth)
+	if a.info.Float {
+		rec.BitDepth += "f"
+	}
+	// The decoded length, not the header's: it is also right for files
+	// cut short by a crash
+	rec.Duration = float64(a.info.Frames) / float64(a.info.SampleRate)
+	peak := float64(a.peak)
+	rec.Peak = &peak
+	rec.Loudness = newLoudness(a.loudness)
+	return rec, a.peaks
+}
+
+// analysis is what decode measures in a recording.
+type analysis struct {
+	info     audiofile.Info // Frames is the decoded length
+	peaks    *audiofile.Peaks
+	peak     float32 // Highest absolute sample value
+	loudness *loudness.Meter
+}
+
+// decode reads the recording at path through, measuring the loudness too
+// if asked. A file that stops decoding halfway returns what was read along
+// with the error; only a file that can't be opened returns nil peaks.
+func decode(path string, measure bool) (analysis, error) {
+	r, err := audiofile.Open(path)
+	if err != nil {
+		return analysis{}, err
+	}
+	defer r.Close()
+	a := analysis{info: r.Info()}
+	b := audiofile.NewPeakBuilder(a.info.Channels, a.info.SampleRate)
+	if measure {
+		a.loudness = loudness.New(a.info.Channels, a.info.SampleRate)
+	}
+	buf := make([]float32, 8192*a.info.Channels)
+	for {
+		n, rerr := r.Read(buf)
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			err = rerr
+			break
+		}
+		block := buf[:n*a.info.Channels]
+		b.Add(block)
+		if a.loudness != nil {
+			a.loudness.Add(block)
+		}
+		for _, s := range block {
+			a.peak = max(a.peak, s, -s)
+		}
+	}
+	a.peaks = b.Peaks()
+	a.info.Frames = a.peaks.Frames
+	return a, err
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"behringerRecorder/lib/loudness"
+	"fmt"
+	"math"
+)
+
+// Loudness is the loudness report of a recording (ITU-R BS.1770, EBU R128),
+// measured when it is indexed. Values that don't exist, like the loudness
+// of silence or the short-term maximum of a take shorter than 3 s, are null.
+type Loudness struct {
+	Integrated   *float64 `json:"integrated"`   // LUFS
+	ShortTermMax *float64 `json:"shortTermMax"` // LUFS
+	Range        float64  `json:"range"`        // LU (LRA)
+	TruePeak     *float64 `json:"truePeak"`     // dBTP
+}
+
+func newLoudness(m *loudness.Meter) *Loudness {
+	finite := func(v float64) *float64 {
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil
+		}
+		v = math.Round(v*100) / 100
+		return &v
+	}
+	return &Loudness{
+		Integrated:   finite(m.Integrated()),
+		ShortTermMax: finite(m.ShortTermMax()),
+		Range:        math.Round(m.Range()*100) / 100,
+		TruePeak:     finite(m.TruePeak()),
+	}
+}
+
+func (l *Loudness) String() string {
+	format := func(v *float64, unit string) string {
+		if v == nil {
+			return "n/a " + unit
+		}
+		return fmt.Sprintf("%.1f %s", *v, unit)
+	}
+	return fmt.Sprintf("%s integrated, %s short-term max, %.1f LU range, %s true peak",
+		format(l.Integrated, "LUFS"), format(l.ShortTermMax, "LUFS"), l.Range, format(l.TruePeak, "dBTP"))
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"behringerRecorder/lib/audiofile"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// peaksDir is the folder of the peak files inside the store folder. Each
+// recording has one, at its name plus ".dat", stamped with the size and
+// modification time of the recording it was made from:
+//
+//	Offset  Size  Field
+//	0       8     Size of the recording
+//	8       8     Modification time of the recording, Unix nanoseconds
+//	16      ...   The peaks, see audiofile.Peaks.WriteTo
+const peaksDir = ".peaks"
+
+// Peaks returns the waveform peaks of recording name. They are written when
+// a take is finished or found by a rescan; a missing or outdated peak file
+// is made again from the recording, which reads it through.
+func (c *Catalog) Peaks(name string) (*audiofile.Peaks, error) {
+	path, err := c.recording(name)
+	if err != nil {
+		return nil, err
+	}
+	name, _ = c.store.Rel(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if p, err := readPeaks(c.peaksPath(name), info); err == nil {
+		return p, nil
+	}
+	a, err := decode(path, false)
+	if a.peaks == nil {
+		return nil, err
+	}
+	if err := writePeaks(c.peaksPath(name), info, a.peaks); err != nil {
+		fmt.Printf("[FILES] Could not save the peaks of %s: %v\n", name, err)
+	}
+	return a.peaks, nil
+}
+
+// peaksPath returns the peak file of recording name.
+func (c *Catalog) peaksPath(name string) string {
+	return filepath.Join(c.store.Dir(), peaksDir, filepath.FromSlash(name)+".dat")
+}
+
+// removePeaks deletes the peak file of recording name.
+func (c *Catalog) removePeaks(name string) {
+	path := c.peaksPath(name)
+	if os.Remove(path) == nil {
+		removeEmptyDirs(filepath.Join(c.store.Dir(), peaksDir), filepath.Dir(path))
+	}
+}
+
+// readPeaks reads a peak file, failing if it wasn't made from the recording
+// described by info.
+func readPeaks(path string, info fs.FileInfo) (*audiofile.Peaks, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var stamp [16]byte
+	if _, err := io.ReadFull(f, stamp[:]); err != nil {
+		return nil, err
+	}
+	if int64(binary.LittleEndian.Uint64(stamp[0:])) != info.Size() ||
+		int64(binary.LittleEndian.Uint64(stamp[8:])) != info.ModTime().UnixNano() {
+		return nil, fmt.Errorf("%s is out of date", path)
+	}
+	return audiofile.ReadPeaks(f)
+}
+
+// writePeaks writes the peak file of the recording described by info.
+func writePeaks(path string, info fs.FileInfo, p *audiofile.Peaks) error {
+	var buf bytes.Buffer
+	var stamp [16]byte
+	binary.LittleEndian.PutUint64(stamp[0:], uint64(info.Size()))
+	binary.LittleEndian.PutUint64(stamp[8:], uint64(info.ModTime().UnixNano()))
+	buf.Write(stamp[:])
+	if _, err := p.WriteTo(&buf); err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, buf.Bytes())
+}
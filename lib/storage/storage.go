@@ -0,0 +1,155 @@
+// Package storage confines file access to the configured folders
+// (storage_location and cloud_drive_location). Every path that comes from a
+// request goes through a Store, which rejects absolute paths, ".." segments
+// and symlinks leading out of the folder.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInvalidPath is wrapped by all errors for paths a Store refuses.
+var ErrInvalidPath = errors.New("invalid path")
+
+// Store is one folder that request paths are resolved against. Names are
+// relative to the folder and use "/" (or the OS separator) between
+// segments, e.g. "Band rehearsal/rec_1700000000.wav".
+type Store struct {
+	dir string
+}
+
+// New returns a Store for the folder dir, which should be absolute. The
+// folder is created on first write if it doesn't exist.
+func New(dir string) *Store {
+	return &Store{dir: filepath.Clean(dir)}
+}
+
+// Dir returns the folder of the store.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Path resolves name to an absolute path inside the store. It fails for
+// empty, absolute and escaping names, hidden names (any segment starting
+// with "."; they hold the app's own files like the trash), names with a
+// NUL byte or (except on Windows) a backslash, and for names whose existing
+// part resolves through a symlink to a place outside the store.
+func (s *Store) Path(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("%w: empty name", ErrInvalidPath)
+	}
+	return s.resolve(name)
+}
+
+// Folder is like Path but also accepts "" (or ".") for the store folder
+// itself, for requests that name a folder to write into.
+func (s *Store) Folder(name string) (string, error) {
+	if name == "" || name == "." {
+		return s.dir, nil
+	}
+	return s.resolve(name)
+}
+
+// Rel returns the name of path (inside the store) as used in requests:
+// relative, with "/" separators.
+func (s *Store) Rel(path string) (string, error) {
+	rel, err := filepath.Rel(s.dir, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%w: %s is outside %s", ErrInvalidPath, path, s.dir)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// Open opens the file name for reading.
+func (s *Store) Open(name string) (*os.File, error) {
+	if _, err := s.Path(name); err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.Open(filepath.FromSlash(name))
+}
+
+// Create creates or truncates the file name, creating the store folder and
+// any missing parent folders first.
+func (s *Store) Create(name string) (*os.File, error) {
+	if _, err := s.Path(name); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	name = filepath.FromSlash(name)
+	if dir := filepath.Dir(name); dir != "." {
+		if err := root.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return root.Create(name)
+}
+
+// resolve joins name onto the store folder and checks that the result, with
+// the symlinks of its existing part followed, stays inside the folder.
+//
+// Open and Create go through os.Root, which also enforces this while the
+// file is opened; paths handed to other code (the recorder, transcoder)
+// are checked here only, which is enough for folders the user doesn't
+// share with untrusted local accounts.
+func (s *Store) resolve(name string) (string, error) {
+	if strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPath, name)
+	}
+	// A backslash separates segments on Windows only; elsewhere a name
+	// with one is refused rather than taken as one odd segment
+	if filepath.Separator != '\\' && strings.ContainsRune(name, '\\') {
+		return "", fmt.Errorf("%w: %q contains a backslash", ErrInvalidPath, name)
+	}
+	local := filepath.Clean(filepath.FromSlash(name))
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("%w: %q must be relative and stay inside the folder", ErrInvalidPath, name)
+	}
+	for _, segment := range strings.Split(local, string(filepath.Separator)) {
+		if strings.HasPrefix(segment, ".") && local != "." {
+			return "", fmt.Errorf("%w: %q is hidden", ErrInvalidPath, name)
+		}
+	}
+	path := filepath.Join(s.dir, local)
+
+	// Follow symlinks of the longest part of the path that exists
+	base, err := filepath.EvalSymlinks(s.dir)
+	if os.IsNotExist(err) {
+		return path, nil // nothing exists yet, so nothing can be linked
+	} else if err != nil {
+		return "", err
+	}
+	for existing := path; existing != s.dir; existing = filepath.Dir(existing) {
+		if _, err := os.Lstat(existing); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		// A dangling link fails here too: creating through it could
+		// write anywhere
+		real, err := filepath.EvalSymlinks(existing)
+		if err != nil {
+			return "", fmt.Errorf("%w: %q can't be resolved", ErrInvalidPath, name)
+		}
+		if rel, err := filepath.Rel(base, real); err != nil || !filepath.IsLocal(rel) {
+			return "", fmt.Errorf("%w: %q links outside the folder", ErrInvalidPath, name)
+		}
+		break
+	}
+	return path, nil
+}
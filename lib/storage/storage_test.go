@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestStore returns a store in a temporary folder, next to a folder
+// outside it, with a symlink "out" to that folder and a dangling symlink
+// "gone".
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "store")
+	outside := filepath.Join(tmp, "outside")
+	for _, d := range []string{filepath.Join(dir, "Session"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.wav"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "out")); err != nil {
+		t.Skipf("no symlinks: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(tmp, "missing"), filepath.Join(dir, "gone")); err != nil {
+		t.Fatal(err)
+	}
+	return New(dir)
+}
+
+func TestStoreRejectsHostileNames(t *testing.T) {
+	s := newTestStore(t)
+	for _, tc := range []struct {
+		what, name string
+	}{
+		{"parent", ".."},
+		{"traversal", "../outside/secret.wav"},
+		{"nested traversal", "Session/../../outside/secret.wav"},
+		{"absolute", "/etc/passwd"},
+		{"absolute into the store", filepath.Join(s.Dir(), "rec.wav")},
+		{"NUL byte", "rec.wav\x00.txt"},
+		{"hidden file", ".recordings.json"},
+		{"trash", ".trash/rec.wav"},
+		{"hidden segment", "Session/.peaks/rec.wav.dat"},
+		{"backslash traversal", `..\outside\secret.wav`},
+		{"backslash separator", `Session\rec.wav`},
+		{"symlink outside", "out/secret.wav"},
+		{"symlink outside itself", "out"},
+		{"file below symlink outside", "out/new.wav"},
+		{"dangling symlink", "gone"},
+		{"below dangling symlink", "gone/rec.wav"},
+	} {
+		t.Run(tc.what, func(t *testing.T) {
+			if path, err := s.Path(tc.name); !errors.Is(err, ErrInvalidPath) {
+				t.Errorf("Path(%q) = %q, %v; want ErrInvalidPath", tc.name, path, err)
+			}
+			if path, err := s.Folder(tc.name); !errors.Is(err, ErrInvalidPath) {
+				t.Errorf("Folder(%q) = %q, %v; want ErrInvalidPath", tc.name, path, err)
+			}
+			if f, err := s.Open(tc.name); err == nil {
+				f.Close()
+				t.Errorf("Open(%q) succeeded", tc.name)
+			}
+			if f, err := s.Create(tc.name); err == nil {
+				f.Close()
+				t.Errorf("Create(%q) succeeded", tc.name)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(s.Dir()), "outside", "new.wav")); err == nil {
+		t.Error("Create wrote outside the store")
+	}
+}
+
+func TestStoreResolvesInside(t *testing.T) {
+	s := newTestStore(t)
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"rec.wav", "rec.wav"},
+		{"Session/rec.wav", "Session/rec.wav"},
+		{"New session/Day 1/rec.wav", "New session/Day 1/rec.wav"},
+		{"Session/../rec.wav", "rec.wav"},
+		{"./Session//rec.wav", "Session/rec.wav"},
+		{"rec..wav", "rec..wav"},
+	} {
+		path, err := s.Path(tc.name)
+		if err != nil {
+			t.Errorf("Path(%q): %v", tc.name, err)
+			continue
+		}
+		if want := filepath.Join(s.Dir(), filepath.FromSlash(tc.want)); path != want {
+			t.Errorf("Path(%q) = %q, want %q", tc.name, path, want)
+		}
+		if rel, err := s.Rel(path); err != nil || rel != tc.want {
+			t.Errorf("Rel(%q) = %q, %v; want %q", path, rel, err, tc.want)
+		}
+	}
+
+	// Create makes the missing folders, Open reads the file back
+	f, err := s.Create("New session/Day 1/rec.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("RIFF")
+	f.Close()
+	if f, err = s.Open("New session/Day 1/rec.wav"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if !strings.HasPrefix(f.Name(), s.Dir()) {
+		t.Errorf("opened %q outside %q", f.Name(), s.Dir())
+	}
+
+	for _, folder := range []string{"", "."} {
+		if path, err := s.Folder(folder); err != nil || path != s.Dir() {
+			t.Errorf("Folder(%q) = %q, %v; want %q", folder, path, err, s.Dir())
+		}
+	}
+	for _, path := range []string{filepath.Dir(s.Dir()), filepath.Join(s.Dir(), "..", "outside")} {
+		if rel, err := s.Rel(path); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Rel(%q) = %q, %v; want ErrInvalidPath", path, rel, err)
+		}
+	}
+}
+
+func TestCatalogSyncListsNewFiles(t *testing.T) {
+	s := New(t.TempDir())
+	c, err := OpenCatalog(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func() []string {
+		list, _, _ := c.Find(Query{})
+		var out []string
+		for _, rec := range list {
+			out = append(out, rec.Name)
+		}
+		return out
+	}
+
+	// Copied in behind the index's back: listed right after Sync, and read
+	// in the background
+	path := filepath.Join(s.Dir(), "Session", "copied.wav")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, []byte("RIFF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(); len(got) != 1 || got[0] != "Session/copied.wav" {
+		t.Fatalf("listed %v after a copy", got)
+	}
+	c.Rescan() // Waits for the background read
+	if rec, _ := c.Get("Session/copied.wav"); rec.Size != 4 || rec.Error == "" {
+		t.Errorf("copied file not read: %+v", rec)
+	}
+
+	os.Remove(path)
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(); len(got) != 0 {
+		t.Errorf("listed %v after removing the file", got)
+	}
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// trashDir is the trash folder inside the store folder. Each deleted
+// recording gets its own entry folder, so equal names can't collide:
+//
+//	.trash/<id>/rec_1700000000.wav
+//	.trash/<id>/entry.json         the TrashEntry
+const trashDir = ".trash"
+
+// TrashEntry is a recording moved to the trash.
+type TrashEntry struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"` // where it is restored to
+	Deleted  time.Time `json:"deleted"`
+	Metadata Metadata  `json:"metadata"`
+	Origin   Origin    `json:"origin"`
+}
+
+// Delete moves recording name to the trash, keeping its origin and
+// metadata. It can be brought back with Restore until the entry is purged.
+func (c *Catalog) Delete(name string) (TrashEntry, error) {
+	src, err := c.recording(name)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	name, _ = c.store.Rel(src)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	entry := TrashEntry{
+		ID:       strconv.FormatInt(now.UnixNano(), 10),
+		Name:     name,
+		Deleted:  now,
+		Metadata: c.recs[name].Metadata,
+		Origin:   c.recs[name].Origin,
+	}
+	dir := filepath.Join(c.store.Dir(), trashDir, entry.ID)
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	if err := WriteFileAtomic(filepath.Join(dir, "entry.json"), data); err != nil {
+		return TrashEntry{}, err
+	}
+	if err := os.Rename(src, filepath.Join(dir, filepath.Base(src))); err != nil {
+		os.RemoveAll(dir)
+		return TrashEntry{}, err
+	}
+	removeEmptyDirs(c.store.Dir(), filepath.Dir(src))
+	c.removePeaks(name)
+	delete(c.recs, name)
+	return entry, c.saveLocked()
+}
+
+// Trash lists the entries of the trash, most recently deleted first.
+func (c *Catalog) Trash() ([]TrashEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dirs, err := os.ReadDir(filepath.Join(c.store.Dir(), trashDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []TrashEntry
+	for _, d := range dirs {
+		if entry, err := c.trashEntryLocked(d.Name()); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortFunc(entries, func(a, b TrashEntry) int { return b.Deleted.Compare(a.Deleted) })
+	return entries, nil
+}
+
+// Restore moves a trash entry back to its original name with its origin and
+// metadata. It fails with ErrExists if a recording of that name was made
+// since.
+func (c *Catalog) Restore(id string) (TrashEntry, error) {
+	entry, err := c.restore(id)
+	if err != nil {
+		return entry, err
+	}
+	path, _ := c.store.Path(entry.Name)
+	c.refresh([]string{path})
+	return entry, nil
+}
+
+func (c *Catalog) restore(id string) (TrashEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, err := c.trashEntryLocked(id)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	dst, err := c.store.Path(entry.Name)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	dir := filepath.Join(c.store.Dir(), trashDir, id)
+	if err := moveFile(filepath.Join(dir, filepath.Base(dst)), dst); err != nil {
+		return TrashEntry{}, err
+	}
+	os.RemoveAll(dir)
+	entry.Name, _ = c.store.Rel(dst)
+	c.recs[entry.Name] = Recording{
+		Name:     entry.Name,
+		Format:   formatOf(dst),
+		Origin:   entry.Origin,
+		Metadata: entry.Metadata,
+	}
+	return entry, c.saveLocked()
+}
+
+// Purge deletes a trash entry for good.
+func (c *Catalog) Purge(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.trashEntryLocked(id); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(c.store.Dir(), trashDir, id))
+}
+
+// trashEntryLocked reads the entry with the given ID. Callers must hold c.mu.
+func (c *Catalog) trashEntryLocked(id string) (TrashEntry, error) {
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return TrashEntry{}, fmt.Errorf("trash entry %q %w", id, ErrNotFound)
+	}
+	data, err := os.ReadFile(filepath.Join(c.store.Dir(), trashDir, id, "entry.json"))
+	if err != nil {
+		return TrashEntry{}, fmt.Errorf("trash entry %q %w", id, ErrNotFound)
+	}
+	var entry TrashEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return TrashEntry{}, fmt.Errorf("trash entry %q: %w", id, err)
+	}
+	return entry, nil
+}
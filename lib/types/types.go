@@ -1,44 +1,223 @@
 package types
 
 import (
+	"maps"
+	"math"
 	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	pa "github.com/gordonklaus/portaudio"
 	"github.com/gorilla/websocket"
 )
 
 type AppState struct {
 	Mu          sync.RWMutex
 	IsRecording bool
+	IsPaused    bool // Recording is paused; the take stays open
 	IsRunning   bool // Engine status
 	DeviceID    int  // Currently connected device ID
 	ChLeft      int
 	ChRight     int
 	Boost       float64
+	Strips      map[int]ChannelStrip // Per input channel trims, see ChannelStrips
+
+	// What the engine applies of the above, see PublishParams
+	Params atomic.Pointer[EngineParams]
+
+	// Named session: takes go to a subfolder of the storage location and
+	// are numbered per session. Empty means no session.
+	Session string
+
+	// Input channels captured into the recording, in file channel order.
+	// Empty means the monitor pair [ChLeft, ChRight].
+	RecordChannels []int
+	// Input channels of the running take, resolved when it starts: routing
+	// changes during the take don't change what it records
+	TakeChannels []int
 
 	File         *os.File
-	SamplesWrote int64
+	TrackFiles   []*os.File // Split-track mode: one mono file per recorded channel, File is nil
+	Encoders     []Encoder  // FLAC takes: one encoder per file (File or TrackFiles), nil for WAV
+	FileFormat   WavFormat  // Format of the take's file(s), fixed when it starts
+	TakePath     string     // Take folder joined with the take name, without extension
+	TakePart     int        // Part being written (1 = first), see Config.SplitEveryMinutes
+	TakeNumber   int        // Number of the current (or last) take in its session
+	SamplesWrote int64      // Sample frames written to the current part
+	CuePoints    []int64    // Sample frame positions of resume points in the current part
 
 	Clients       map[*WSClient]bool
 	PrimaryClient *WSClient // Client with primary control
 	QuitAudio     chan bool
+	MeterResets   int // Bumped by "resetMeters" to clear the clip counters and peak holds of the live meters
+
+	// Gain reduction of the running engine's limiter, nil when it has none
+	GainReduction *GainReduction
+	// Clip counts of the running engine's inputs, nil while none runs
+	Clips *Clips
 
 	// Communication channels
 	RecordChan   chan []float32
 	PlaybackChan chan []float32
+	MeterChan    chan []float32 // The recorded chunks again, for the input meters
 
 	StorageLocation    string
 	CloudDriveLocation string
 
 	// Audio Devices cache
-	Devices []*pa.DeviceInfo
+	Devices []Device
+}
+
+// Device is an input device of one of the audio source backends.
+type Device struct {
+	Name    string
+	Inputs  int    // Input channels
+	Backend string // Audio source backend that opens it, see config.Config.Source
+	Index   int    // The backend's own number of the device
+}
+
+// RecordingChannels returns the input channels to record: those of the
+// running take, or else the selection, falling back to the stereo monitor
+// pair when no explicit selection was made. Callers must hold Mu.
+func (s *AppState) RecordingChannels() []int {
+	if s.IsRecording && len(s.TakeChannels) > 0 {
+		return s.TakeChannels
+	}
+	if len(s.RecordChannels) == 0 {
+		return []int{s.ChLeft, s.ChRight}
+	}
+	return s.RecordChannels
+}
+
+// EngineParams are the settings the engine applies to the audio. It loads
+// them for every buffer without locking Mu, which the storage worker holds
+// while writing; so a published EngineParams is never modified, changes
+// publish a new one.
+type EngineParams struct {
+	ChLeft, ChRight int
+	RecordChannels  []int // See RecordingChannels
+	Boost           float64
+	Strips          map[int]ChannelStrip
+}
+
+// PublishParams hands the current routing and gains to the engine. It must
+// be called after changing any of them, and when a take starts or stops.
+// Callers must hold Mu.
+func (s *AppState) PublishParams() {
+	s.Params.Store(&EngineParams{
+		ChLeft:         s.ChLeft,
+		ChRight:        s.ChRight,
+		RecordChannels: slices.Clone(s.RecordingChannels()),
+		Boost:          s.Boost,
+		Strips:         s.Strips,
+	})
+}
+
+// ChannelStrip is the trim of one input channel. Gain, polarity and mute
+// apply to the channel as recorded and monitored, pan only to the monitor
+// pair. The zero value leaves the channel as it is.
+type ChannelStrip struct {
+	Gain   float64  `json:"gain"` // dB
+	Invert bool     `json:"invert"`
+	Mute   bool     `json:"mute"`
+	Pan    *float64 `json:"pan"` // -1 (left) to 1 (right); nil keeps the channel on its side of the monitor pair
+}
+
+// ChannelStrips returns the channel strips that differ from the zero value,
+// by input channel. The map must not be modified, the engine may be reading
+// it. Callers must hold Mu.
+func (s *AppState) ChannelStrips() map[int]ChannelStrip {
+	if s.Strips == nil {
+		return map[int]ChannelStrip{}
+	}
+	return s.Strips
+}
+
+// SetChannelStrip replaces the strip of input channel ch and publishes it
+// to the engine. Callers must hold Mu.
+func (s *AppState) SetChannelStrip(ch int, strip ChannelStrip) {
+	strips := maps.Clone(s.ChannelStrips())
+	if strip == (ChannelStrip{}) {
+		delete(strips, ch)
+	} else {
+		strips[ch] = strip
+	}
+	s.Strips = strips
+	s.PublishParams()
+}
+
+// GainReduction is the gain reduction of the engine's limiter per input
+// channel, in dB. The engine records the deepest of every buffer and the
+// meters take the deepest since they last looked; neither waits for the
+// other, so it is kept in atomics rather than under Mu.
+type GainReduction struct {
+	channels []atomic.Uint64 // math.Float64bits of the dB value
+}
+
+func NewGainReduction(channels int) *GainReduction {
+	return &GainReduction{channels: make([]atomic.Uint64, channels)}
+}
+
+// Record notes a gain reduction of db on input channel ch.
+func (g *GainReduction) Record(ch int, db float64) {
+	if ch < 0 || ch >= len(g.channels) {
+		return
+	}
+	v := &g.channels[ch]
+	for {
+		old := v.Load()
+		if db <= math.Float64frombits(old) || v.CompareAndSwap(old, math.Float64bits(db)) {
+			return
+		}
+	}
+}
+
+// Take returns the deepest gain reduction of input channel ch since the
+// last call, and false for channels the engine doesn't have.
+func (g *GainReduction) Take(ch int) (float64, bool) {
+	if ch < 0 || ch >= len(g.channels) {
+		return 0, false
+	}
+	return math.Float64frombits(g.channels[ch].Swap(0)), true
+}
+
+// Clips counts the runs of samples at full scale per input channel, where
+// the engine clamps them: after the gains and the limiter, before the pan
+// of the monitor pair. The counts only grow, so any number of meters can
+// read them; like GainReduction they are kept in atomics.
+type Clips struct {
+	channels []atomic.Int64
+}
+
+func NewClips(channels int) *Clips {
+	return &Clips{channels: make([]atomic.Int64, channels)}
+}
+
+// Add counts n more runs on input channel ch.
+func (c *Clips) Add(ch int, n int64) {
+	if ch >= 0 && ch < len(c.channels) {
+		c.channels[ch].Add(n)
+	}
+}
+
+// Total returns the runs of input channel ch since the engine started, and
+// false for channels the engine doesn't have.
+func (c *Clips) Total(ch int) (int64, bool) {
+	if ch < 0 || ch >= len(c.channels) {
+		return 0, false
+	}
+	return c.channels[ch].Load(), true
 }
 
 // WSClient wraps a websocket connection with a mutex for thread-safe writes.
 type WSClient struct {
 	Conn *websocket.Conn
 	Mu   sync.Mutex
+
+	// Optional message types the client subscribed to, e.g. "spectrum".
+	// Guarded by AppState.Mu.
+	Topics map[string]bool
 }
 
 func (c *WSClient) WriteJSON(v interface{}) error {
@@ -57,6 +236,56 @@ func (c *WSClient) Close() error {
 	return c.Conn.Close()
 }
 
+// WavFormat describes how a take is written to disk. For split-track takes
+// it describes the whole take; each mono track file has Channels = 1.
+type WavFormat struct {
+	Channels   int
+	SampleRate int
+	BitDepth   int       // 16, 24 or 32
+	Float      bool      // 32-bit IEEE float samples instead of integer PCM
+	Flac       bool      // FLAC compressed file instead of WAV (integer PCM only)
+	Bext       *BextInfo // Broadcast Wave metadata, nil for plain WAV
+}
+
+// SampleSize returns the size of one sample in bytes.
+func (f WavFormat) SampleSize() int {
+	return f.BitDepth / 8
+}
+
+// BlockAlign returns the size of one sample frame (all channels) in bytes.
+func (f WavFormat) BlockAlign() int {
+	return f.Channels * f.SampleSize()
+}
+
+// Extension returns the file extension of the take's file(s).
+func (f WavFormat) Extension() string {
+	if f.Flac {
+		return ".flac"
+	}
+	return ".wav"
+}
+
+// Encoder compresses one file of a take. The storage worker passes it the
+// take's samples as interleaved integers of the take's BitDepth instead of
+// writing PCM to the file itself.
+type Encoder interface {
+	Write(samples []int32) error
+	// Sync makes everything encoded so far durable and readable after a crash.
+	Sync() error
+	// Close encodes the remaining samples, finalizes and closes the file.
+	Close() error
+}
+
+// BextInfo is the Broadcast Wave Format (EBU Tech 3285) metadata written to
+// the "bext" chunk of a take.
+type BextInfo struct {
+	Description         string
+	Originator          string // Usually the capture device name
+	OriginatorReference string
+	OriginationTime     time.Time // When the take was started
+	TimeReference       uint64    // First sample of the take, in samples since midnight
+}
+
 type AudioDevice struct {
 	ID   int    `json:"id"`
 	Name string `json:"name"`
@@ -0,0 +1,356 @@
+package web
+
+import (
+	"behringerRecorder/lib/audiofile"
+	"behringerRecorder/lib/config"
+	"behringerRecorder/lib/portaudio"
+	"behringerRecorder/lib/storage"
+	"behringerRecorder/lib/types"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job is a background transcode of one recording.
+type Job struct {
+	ID       int                        `json:"id"`
+	Source   string                     `json:"source"` // relative to storage_location
+	Target   string                     `json:"target"` // relative to storage_location
+	Options  portaudio.TranscodeOptions `json:"options"`
+	Status   string                     `json:"status"`
+	Progress float64                    `json:"progress"` // 0.0 to 1.0
+	Error    string                     `json:"error,omitempty"`
+	Created  time.Time                  `json:"created"`
+
+	src, dst string // absolute paths
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// JobManager runs transcode jobs in the background, one at a time in the
+// order they were submitted, so long conversions never hold up recording or
+// the control API. Every change of a
+// job is broadcast to the WebSocket clients as a "job" message:
+//
+//	{"type": "job", "job": {"id": 1, "status": "running", "progress": 0.42, ...}}
+//
+// Running jobs report progress at most every jobProgressInterval.
+type JobManager struct {
+	state   *types.AppState
+	cfg     *config.Config
+	catalog *storage.Catalog
+	store   *storage.Store
+
+	mu     sync.Mutex
+	jobs   []*Job // all jobs, oldest first
+	queue  []*Job // queued jobs, next first
+	nextID int
+	wake   chan struct{}
+}
+
+const jobProgressInterval = 250 * time.Millisecond
+
+// NewJobManager starts the worker that runs the submitted jobs. Finished
+// outputs are added to the catalog, with the origin and metadata of their
+// source.
+func NewJobManager(state *types.AppState, cfg *config.Config, catalog *storage.Catalog) *JobManager {
+	m := &JobManager{state: state, cfg: cfg, catalog: catalog, store: catalog.Store(), nextID: 1, wake: make(chan struct{}, 1)}
+	go m.worker()
+	return m
+}
+
+// Submit queues a transcode of source (relative to storage_location) into
+// target, deriving the target name from the options when it is empty. An
+// empty dither uses the config default, an empty bit depth that of the
+// source. The target must not exist nor be
+// the target of a queued or running job. It returns a snapshot of the
+// queued job.
+func (m *JobManager) Submit(source, target string, opts portaudio.TranscodeOptions) (Job, error) {
+	if opts.Dither == "" {
+		opts.Dither = m.cfg.Dither
+	}
+	if err := opts.Validate(); err != nil {
+		return Job{}, err
+	}
+	src, err := m.store.Path(source)
+	if err != nil {
+		return Job{}, err
+	}
+	if info, err := os.Stat(src); err != nil || info.IsDir() {
+		return Job{}, fmt.Errorf("source file not found")
+	}
+	if opts.BitDepth == "" {
+		info, err := audiofile.Inspect(src)
+		if err != nil {
+			return Job{}, err
+		}
+		flac, _ := portaudio.ParseFileFormat(opts.FileFormat)
+		opts.BitDepth = portaudio.SourceBitDepth(info, flac)
+	}
+	if isRecordingFile(m.state, src) {
+		return Job{}, fmt.Errorf("source is still being recorded")
+	}
+	if target == "" {
+		target = transcodeTarget(source, opts)
+	}
+	dst, err := m.store.Path(target)
+	if err != nil {
+		return Job{}, err
+	}
+	if dst == src {
+		return Job{}, fmt.Errorf("target must differ from source")
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return Job{}, fmt.Errorf("target %s already exists", target)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	for _, other := range m.jobs {
+		if other.dst == dst && (other.Status == JobQueued || other.Status == JobRunning) {
+			m.mu.Unlock()
+			cancel()
+			return Job{}, fmt.Errorf("target %s is the target of job %d", target, other.ID)
+		}
+	}
+	job := &Job{
+		ID:      m.nextID,
+		Source:  source,
+		Target:  target,
+		Options: opts,
+		Status:  JobQueued,
+		Created: time.Now(),
+		src:     src,
+		dst:     dst,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	m.nextID++
+	m.jobs = append(m.jobs, job)
+	m.queue = append(m.queue, job)
+	snapshot := *job
+	m.mu.Unlock()
+
+	fmt.Printf("[JOBS] Queued job %d: %s -> %s\n", job.ID, source, target)
+	m.broadcast(job)
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+	return snapshot, nil
+}
+
+// errJobNotFound is returned by Cancel for unknown job IDs.
+var errJobNotFound = errors.New("job not found")
+
+// Cancel stops a queued or running job. A queued job is cancelled right
+// away; a running one stops at its next block and removes its output.
+func (m *JobManager) Cancel(id int) error {
+	m.mu.Lock()
+	for _, job := range m.jobs {
+		if job.ID != id {
+			continue
+		}
+		switch job.Status {
+		case JobQueued:
+			for i, q := range m.queue {
+				if q == job {
+					m.queue = append(m.queue[:i], m.queue[i+1:]...)
+					break
+				}
+			}
+			m.mu.Unlock()
+			m.finish(job, context.Canceled)
+			return nil
+		case JobRunning:
+			job.cancel()
+			m.mu.Unlock()
+			return nil
+		}
+		m.mu.Unlock()
+		return fmt.Errorf("job %d is already %s", id, job.Status)
+	}
+	m.mu.Unlock()
+	return errJobNotFound
+}
+
+// List returns a snapshot of all jobs, oldest first.
+func (m *JobManager) List() []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Job, len(m.jobs))
+	for i, job := range m.jobs {
+		list[i] = *job
+	}
+	return list
+}
+
+// worker runs the queued jobs one after another.
+func (m *JobManager) worker() {
+	for {
+		m.mu.Lock()
+		if len(m.queue) == 0 {
+			m.mu.Unlock()
+			<-m.wake
+			continue
+		}
+		job := m.queue[0]
+		m.queue = m.queue[1:]
+		job.Status = JobRunning
+		m.mu.Unlock()
+		m.broadcast(job)
+		fmt.Printf("[JOBS] Running job %d\n", job.ID)
+
+		var last time.Time
+		err := portaudio.Transcode(job.ctx, job.src, job.dst, job.Options, func(p float64) {
+			if time.Since(last) < jobProgressInterval {
+				return
+			}
+			last = time.Now()
+			m.update(job, func() { job.Progress = p })
+		})
+		if err == nil {
+			name, _ := m.store.Rel(job.src)
+			src, _ := m.catalog.Get(name)
+			m.catalog.Add([]string{job.dst}, src.Origin, src.Metadata)
+		}
+		m.finish(job, err)
+	}
+}
+
+// finish records the outcome of a job.
+func (m *JobManager) finish(job *Job, err error) {
+	m.update(job, func() {
+		switch {
+		case err == nil:
+			job.Status = JobDone
+			job.Progress = 1
+		case errors.Is(err, context.Canceled):
+			job.Status = JobCancelled
+		default:
+			job.Status = JobFailed
+			job.Error = err.Error()
+		}
+		job.cancel()
+	})
+	fmt.Printf("[JOBS] Job %d %s\n", job.ID, job.Status)
+}
+
+// update changes a job under the lock and broadcasts it.
+func (m *JobManager) update(job *Job, change func()) {
+	m.mu.Lock()
+	change()
+	m.mu.Unlock()
+	m.broadcast(job)
+}
+
+func (m *JobManager) broadcast(job *Job) {
+	m.mu.Lock()
+	msg := struct {
+		Type string `json:"type"`
+		Job  Job    `json:"job"`
+	}{"job", *job}
+	m.mu.Unlock()
+
+	// Submit, Cancel and the worker broadcast from different goroutines:
+	// the deadline is set under the client's lock, with the write
+	m.state.Mu.RLock()
+	defer m.state.Mu.RUnlock()
+	for c := range m.state.Clients {
+		c.Mu.Lock()
+		c.Conn.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+		c.Conn.WriteJSON(msg)
+		c.Mu.Unlock()
+	}
+}
+
+// transcodeTarget derives the output name from the source and options, e.g.
+// rec_1700000000.wav to 22050 Hz mono 16-bit FLAC becomes
+// rec_1700000000_22050hz_mono_16bit.flac.
+func transcodeTarget(source string, opts portaudio.TranscodeOptions) string {
+	name := strings.TrimSuffix(source, filepath.Ext(source))
+	if opts.SampleRate > 0 {
+		name += fmt.Sprintf("_%dhz", opts.SampleRate)
+	}
+	if opts.Mono {
+		name += "_mono"
+	}
+	switch opts.BitDepth {
+	case "", "16", "24":
+		bits, _, _ := portaudio.ParseBitDepth(opts.BitDepth)
+		name += fmt.Sprintf("_%dbit", bits)
+	default:
+		name += "_" + opts.BitDepth
+	}
+	if opts.FileFormat == "flac" {
+		return name + ".flac"
+	}
+	return name + ".wav"
+}
+
+// JobsHandler serves the transcode job API:
+//
+//	GET    /api/jobs       list all jobs
+//	POST   /api/jobs       submit {"source": "rec_1.wav", "target": "", "options": {...}}
+//	DELETE /api/jobs/{id}  cancel a queued or running job
+func JobsHandler(jobs *JobManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(jobs.List())
+
+		case http.MethodPost:
+			var req struct {
+				Source  string                     `json:"source"`
+				Target  string                     `json:"target"`
+				Options portaudio.TranscodeOptions `json:"options"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body", 400)
+				return
+			}
+			job, err := jobs.Submit(req.Source, req.Target, req.Options)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(job)
+
+		case http.MethodDelete:
+			id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/jobs/"))
+			if err != nil {
+				http.Error(w, "Invalid job ID", 400)
+				return
+			}
+			if err := jobs.Cancel(id); err == errJobNotFound {
+				http.Error(w, err.Error(), 404)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+
+		default:
+			http.Error(w, "Method not allowed", 405)
+		}
+	}
+}
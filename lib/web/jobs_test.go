@@ -0,0 +1,203 @@
+package web
+
+import (
+	"behringerRecorder/lib/config"
+	"behringerRecorder/lib/portaudio"
+	"behringerRecorder/lib/storage"
+	"behringerRecorder/lib/types"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeSilence writes a 16-bit stereo WAV file of the given length. The
+// audio is a hole in the file, so long sources cost no disk space.
+func writeSilence(t *testing.T, path string, seconds int) {
+	t.Helper()
+	format := types.WavFormat{Channels: 2, SampleRate: 48000, BitDepth: 16}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portaudio.WritePlaceholderHeader(f, format)
+	frames := int64(seconds * format.SampleRate)
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(st.Size() + frames*int64(format.BlockAlign())); err != nil {
+		t.Fatal(err)
+	}
+	portaudio.FinalizeWavHeader(f, format, frames)
+}
+
+// newTestJobManager returns a job manager over a store in a temporary
+// folder, and the jobs it broadcasts to a WebSocket client.
+func newTestJobManager(t *testing.T) (*JobManager, string, <-chan Job) {
+	t.Helper()
+	dir := t.TempDir()
+	catalog, err := storage.OpenCatalog(storage.New(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &types.AppState{Clients: map[*types.WSClient]bool{}}
+
+	registered := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		state.Mu.Lock()
+		state.Clients[&types.WSClient{Conn: conn}] = true
+		state.Mu.Unlock()
+		close(registered)
+	}))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	<-registered
+
+	events := make(chan Job, 100)
+	go func() {
+		defer close(events)
+		for {
+			var msg struct {
+				Type string `json:"type"`
+				Job  Job    `json:"job"`
+			}
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if msg.Type == "job" {
+				events <- msg.Job
+			}
+		}
+	}()
+	return NewJobManager(state, &config.Config{}, catalog), dir, events
+}
+
+// waitFor reads events until job id reaches status and returns the status
+// changes seen on the way, as "id status".
+func waitFor(t *testing.T, events <-chan Job, seen map[int]string, id int, status string) []string {
+	t.Helper()
+	var changes []string
+	timeout := time.After(30 * time.Second)
+	for seen[id] != status {
+		select {
+		case job, ok := <-events:
+			if !ok {
+				t.Fatalf("connection closed waiting for job %d to be %s", id, status)
+			}
+			if seen[job.ID] != job.Status {
+				seen[job.ID] = job.Status
+				changes = append(changes, job.Status+" "+job.Target)
+			}
+		case <-timeout:
+			t.Fatalf("job %d still %s, waiting for %s", id, seen[id], status)
+		}
+	}
+	return changes
+}
+
+func TestJobManagerQueueCancelAndTargets(t *testing.T) {
+	m, dir, events := newTestJobManager(t)
+	for _, name := range []string{"a.wav", "b.wav", "c.wav"} {
+		writeSilence(t, filepath.Join(dir, name), 1)
+	}
+	// Long enough to still be running while the test goes on
+	writeSilence(t, filepath.Join(dir, "long.wav"), 3600)
+	if err := os.WriteFile(filepath.Join(dir, "taken.flac"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	seen := map[int]string{}
+	opts := portaudio.TranscodeOptions{FileFormat: "flac", BitDepth: "16"}
+
+	long, err := m.Submit("long.wav", "", portaudio.TranscodeOptions{SampleRate: 44100, BitDepth: "24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, events, seen, long.ID, JobRunning)
+
+	// Queued behind it, in order
+	var ids []int
+	for _, name := range []string{"a.wav", "b.wav", "c.wav"} {
+		job, err := m.Submit(name, "", opts)
+		if err != nil {
+			t.Fatalf("submitting %s: %v", name, err)
+		}
+		if job.Status != JobQueued || job.Target != strings.TrimSuffix(name, ".wav")+"_16bit.flac" {
+			t.Errorf("submitted %s: %s to %s, want queued to its default target", name, job.Status, job.Target)
+		}
+		ids = append(ids, job.ID)
+	}
+
+	// Targets of queued jobs and existing files are refused
+	for _, tc := range []struct {
+		source, target, err string
+	}{
+		{"c.wav", "a_16bit.flac", "target of job"},
+		{"b.wav", "", "target of job"},
+		{"a.wav", "taken.flac", "already exists"},
+		{"a.wav", "a.wav", "must differ"},
+	} {
+		if _, err := m.Submit(tc.source, tc.target, opts); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("submitting %s to %q: %v, want an error about %q", tc.source, tc.target, err, tc.err)
+		}
+	}
+
+	// A queued job is cancelled at once, the running one at its next block
+	if err := m.Cancel(ids[1]); err != nil {
+		t.Fatalf("cancelling queued job: %v", err)
+	}
+	if err := m.Cancel(ids[1]); err == nil {
+		t.Error("cancelling a cancelled job succeeded")
+	}
+	if err := m.Cancel(999); !errors.Is(err, errJobNotFound) {
+		t.Errorf("cancelling an unknown job: %v, want %v", err, errJobNotFound)
+	}
+	if err := m.Cancel(long.ID); err != nil {
+		t.Fatalf("cancelling running job: %v", err)
+	}
+	changes := waitFor(t, events, seen, ids[2], JobDone)
+
+	want := []string{
+		"queued a_16bit.flac", "queued b_16bit.flac", "queued c_16bit.flac",
+		"cancelled b_16bit.flac",
+		"cancelled " + long.Target,
+		"running a_16bit.flac", "done a_16bit.flac",
+		"running c_16bit.flac", "done c_16bit.flac",
+	}
+	if !slices.Equal(changes, want) {
+		t.Errorf("jobs went\n  %s\nwant\n  %s", strings.Join(changes, "\n  "), strings.Join(want, "\n  "))
+	}
+	if _, err := os.Stat(filepath.Join(dir, long.Target)); !os.IsNotExist(err) {
+		t.Errorf("output of the cancelled job left behind: %v", err)
+	}
+	for _, name := range []string{"a_16bit.flac", "c_16bit.flac"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("output missing: %v", err)
+		}
+		if _, ok := m.catalog.Get(name); !ok {
+			t.Errorf("output %s not in the catalog", name)
+		}
+	}
+
+	// The target of the cancelled job is free again
+	job, err := m.Submit("b.wav", "", opts)
+	if err != nil {
+		t.Fatalf("resubmitting b.wav: %v", err)
+	}
+	waitFor(t, events, seen, job.ID, JobDone)
+}
@@ -0,0 +1,263 @@
+package web
+
+import (
+	"behringerRecorder/lib/loudness"
+	"behringerRecorder/lib/types"
+	"math"
+	"slices"
+)
+
+const (
+	// meterVersion is the version of the meter message. It changes when
+	// fields change meaning or go away; new fields don't change it.
+	meterVersion = 1
+
+	rmsSeconds      = 0.3  // Integration time of the RMS level
+	peakHoldSeconds = 2.0  // How long a peak is held before it decays
+	peakDecayDB     = 20.0 // Decay of the held peak in dB per second
+)
+
+// meterMessage is sent to all clients every 100 ms of audio, with one entry
+// per monitor channel (left, right):
+//
+//	{"type": "meters", "version": 1,
+//	 "momentary": -18.3, "shortTerm": -19.1,
+//	 "channels": [{"peak": -6.1, "peakHold": -3.2, "rms": -14.5,
+//	               "momentary": -21.2, "shortTerm": -22.0, "clips": 0}, ...]}
+//
+// Levels are in dBFS and loudness in LUFS, rounded to 0.1 dB; null means
+// silence, or for loudness less audio than its window (400 ms momentary,
+// 3 s short-term). The top level loudness is that of both channels
+// together. clips counts the runs of samples the engine clipped on the
+// input of the channel, before the pan, since the take started or the
+// meters were reset. With the limiter on, channels also have
+// "gainReduction", the deepest since the last message in dB.
+//
+// While the engine runs, "inputs" has the same levels for every recorded
+// input channel, in file channel order, each with its number as "input":
+//
+//	"inputs": [{"input": 4, "peak": -12.0, ...}, ...]
+type meterMessage struct {
+	Type      string         `json:"type"`
+	Version   int            `json:"version"`
+	Momentary *float64       `json:"momentary"`
+	ShortTerm *float64       `json:"shortTerm"`
+	Channels  []channelLevel `json:"channels"`
+
+	Inputs []inputLevel `json:"inputs,omitempty"`
+}
+
+type channelLevel struct {
+	Peak      *float64 `json:"peak"`     // Highest sample since the last message
+	PeakHold  *float64 `json:"peakHold"` // Highest recent peak, decaying
+	RMS       *float64 `json:"rms"`
+	Momentary *float64 `json:"momentary"`
+	ShortTerm *float64 `json:"shortTerm"`
+	Clips     int      `json:"clips"`
+
+	GainReduction *float64 `json:"gainReduction,omitempty"` // Set by the broadcaster
+}
+
+// inputLevel is the level of one recorded input channel.
+type inputLevel struct {
+	Input int `json:"input"`
+	channelLevel
+}
+
+// channelMeter is the state of one channel of the meters.
+type channelMeter struct {
+	loudness *loudness.Meter
+	ms       float64 // Mean square, integrated over rmsSeconds
+	peak     float32 // Since the last message
+	hold     float64 // Held peak, linear
+	holdAge  float64 // Seconds since the held peak was set
+	clips    int
+	input    int   // Input channel the clips were counted on, -1 for none yet
+	seen     int64 // Clips.Total of input when last counted
+	mono     []float32
+}
+
+// meterBank measures the monitor pair, or the recorded channels, for the
+// meter messages; program, the loudness of all channels together, is nil
+// for the latter. It is used by the broadcaster goroutine only.
+type meterBank struct {
+	channels []channelMeter
+	program  *loudness.Meter
+	rmsCoef  float64 // Per-sample step of the RMS integrator
+	interval int     // Frames per message
+	frames   int     // Frames since the last message
+	rate     int
+
+	clips *types.Clips // The engine's clip counts, as last read
+}
+
+func newMeterBank(channels, sampleRate int) *meterBank {
+	b := &meterBank{
+		channels: make([]channelMeter, channels),
+		program:  loudness.NewWithoutTruePeak(channels, sampleRate),
+		rmsCoef:  1 - math.Exp(-1/(rmsSeconds*float64(sampleRate))),
+		interval: max(sampleRate/10, 1),
+		rate:     sampleRate,
+	}
+	for i := range b.channels {
+		b.channels[i].loudness = loudness.NewWithoutTruePeak(1, sampleRate)
+		b.channels[i].input = -1
+	}
+	return b
+}
+
+// reset clears the clip counters and peak holds.
+func (b *meterBank) reset() {
+	for i := range b.channels {
+		b.channels[i].clips = 0
+		b.channels[i].hold = 0
+	}
+}
+
+// add measures an interleaved chunk and returns the meter message once
+// 100 ms of audio went by since the last one.
+func (b *meterBank) add(chunk []float32) (meterMessage, bool) {
+	n := len(b.channels)
+	frames := len(chunk) / n
+	if b.program != nil {
+		b.program.Add(chunk)
+	}
+	for c := range b.channels {
+		m := &b.channels[c]
+		m.mono = m.mono[:0]
+		for i := c; i < frames*n; i += n {
+			s := chunk[i]
+			m.mono = append(m.mono, s)
+			m.ms += b.rmsCoef * (float64(s)*float64(s) - m.ms)
+			m.peak = max(m.peak, s, -s)
+		}
+		m.loudness.Add(m.mono)
+	}
+
+	if b.frames += frames; b.frames < b.interval {
+		return meterMessage{}, false
+	}
+	elapsed := float64(b.frames) / float64(b.rate)
+	b.frames = 0
+
+	msg := meterMessage{
+		Type:     "meters",
+		Version:  meterVersion,
+		Channels: make([]channelLevel, n),
+	}
+	if b.program != nil {
+		msg.Momentary = decibels(b.program.Momentary())
+		msg.ShortTerm = decibels(b.program.ShortTerm())
+	}
+	for c := range b.channels {
+		m := &b.channels[c]
+		peak := float64(m.peak)
+		if peak >= m.hold {
+			m.hold, m.holdAge = peak, 0
+		} else if m.holdAge += elapsed; m.holdAge > peakHoldSeconds {
+			m.hold = max(m.hold*math.Pow(10, -peakDecayDB*elapsed/20), peak)
+		}
+		msg.Channels[c] = channelLevel{
+			Peak:      decibels(20 * math.Log10(peak)),
+			PeakHold:  decibels(20 * math.Log10(m.hold)),
+			RMS:       decibels(10 * math.Log10(m.ms)),
+			Momentary: decibels(m.loudness.Momentary()),
+			ShortTerm: decibels(m.loudness.ShortTerm()),
+			Clips:     m.clips,
+		}
+		m.peak = 0
+	}
+	return msg, true
+}
+
+// countClips adds the runs the engine clipped since the last call on the
+// input channel of each meter channel, and sets them in msg. A channel
+// switched to another input, or to a new engine, counts from the switch on.
+func (b *meterBank) countClips(inputs []int, clips *types.Clips, msg *meterMessage) {
+	if clips != b.clips {
+		b.clips = clips
+		for c := range b.channels {
+			b.channels[c].input = -1
+		}
+	}
+	for c, input := range inputs {
+		m := &b.channels[c]
+		total, ok := clips.Total(input)
+		if !ok {
+			continue
+		}
+		if input == m.input {
+			m.clips += int(total - m.seen)
+		}
+		m.input, m.seen = input, total
+		msg.Channels[c].Clips = m.clips
+	}
+}
+
+// inputMeters measures the recorded input channels for the "inputs" of the
+// meter message, from the chunks the engine records. It is used by the
+// broadcaster goroutine only.
+type inputMeters struct {
+	bank       *meterBank
+	channels   []int // Input channels of bank, in chunk order
+	levels     meterMessage
+	fresh      bool // levels wasn't taken yet
+	rate       int
+	bufferSize int
+}
+
+func newInputMeters(sampleRate, bufferSize int) *inputMeters {
+	return &inputMeters{rate: sampleRate, bufferSize: bufferSize}
+}
+
+// add measures a recorded chunk of the given input channels. Chunks that
+// don't fit them were made before a routing change and are skipped; other
+// channels start new meters.
+func (m *inputMeters) add(chunk []float32, channels []int) {
+	if len(channels) == 0 || len(chunk) != m.bufferSize*len(channels) {
+		return
+	}
+	if !slices.Equal(channels, m.channels) {
+		m.bank = newMeterBank(len(channels), m.rate)
+		m.bank.program = nil
+		m.channels = slices.Clone(channels)
+		m.fresh = false
+	}
+	if msg, due := m.bank.add(chunk); due {
+		m.levels, m.fresh = msg, true
+	}
+}
+
+// reset clears the clip counters and peak holds.
+func (m *inputMeters) reset() {
+	if m.bank != nil {
+		m.bank.reset()
+	}
+}
+
+// take returns the levels measured since the last call, with the clips
+// counted in clips (nil for none), or nil when there are none.
+func (m *inputMeters) take(clips *types.Clips) []inputLevel {
+	if !m.fresh {
+		return nil
+	}
+	m.fresh = false
+	if clips != nil {
+		m.bank.countClips(m.channels, clips, &m.levels)
+	}
+	levels := make([]inputLevel, len(m.channels))
+	for i, ch := range m.channels {
+		levels[i] = inputLevel{Input: ch, channelLevel: m.levels.Channels[i]}
+	}
+	return levels
+}
+
+// decibels rounds a level to 0.1 dB for the meter message, with nil for
+// silence (-Inf) and anything quieter than the 24-bit noise floor.
+func decibels(v float64) *float64 {
+	if math.IsNaN(v) || v < -150 {
+		return nil
+	}
+	v = math.Round(v*10) / 10
+	return &v
+}
@@ -1,6 +1,7 @@
 package web
 
 import (
+	"behringerRecorder/lib/config"
 	"behringerRecorder/lib/types"
 	"encoding/binary"
 	"math"
@@ -59,17 +60,81 @@ func CalculatePeakMeters(buffer []float32) (float32, float32) {
 //	  Bytes 12-15: cd cc 9e be (-0.3 as float32 audio sample)
 //	  Bytes 16-19: cd cc cc 3d (0.1 as float32 audio sample)
 //	  Bytes 20-23: cd cc 23 3e (0.2 as float32 audio sample)
-func StartAudioBroadcaster(state *types.AppState, playbackChan <-chan []float32) {
+//
+// Every 100 ms of audio it also sends the full meters (RMS, peak hold,
+// loudness, clip counters) of the monitor pair and of the recorded chunks
+// from meterChan as a JSON "meters" message, see meterMessage, and to
+// subscribed clients the "spectrum" message, see spectrumMessage.
+func StartAudioBroadcaster(state *types.AppState, cfg *config.Config, playbackChan, meterChan <-chan []float32) {
 	go func() {
-		for chunk := range playbackChan {
+		meters := newMeterBank(2, cfg.SampleRate)
+		inputs := newInputMeters(cfg.SampleRate, cfg.BufferSize)
+		spectrum := newSpectrumAnalyser(2, cfg)
+		resets, recording := 0, false
+		for {
+			var chunk []float32
+			select {
+			case rec, ok := <-meterChan:
+				if !ok {
+					meterChan = nil
+				} else if params := state.Params.Load(); params != nil {
+					inputs.add(rec, params.RecordChannels)
+				}
+				continue
+			case c, ok := <-playbackChan:
+				if !ok {
+					return
+				}
+				chunk = c
+			}
+
 			maxL, maxR := CalculatePeakMeters(chunk)
+			levels, due := meters.add(chunk)
+			spectrumDue := spectrum.add(chunk)
 
 			state.Mu.RLock()
+			// A new take or a "resetMeters" request clears the clip
+			// counters and peak holds
+			if state.MeterResets != resets || state.IsRecording && !recording {
+				meters.reset()
+				inputs.reset()
+			}
+			resets, recording = state.MeterResets, state.IsRecording
+			if due {
+				monitor := []int{state.ChLeft, state.ChRight}
+				if state.Clips != nil {
+					meters.countClips(monitor, state.Clips, &levels)
+				}
+				levels.Inputs = inputs.take(state.Clips)
+				if gr := state.GainReduction; gr != nil {
+					// Take clears it: read every input once
+					taken := map[int]*float64{}
+					reduction := func(ch int) *float64 {
+						if db, ok := taken[ch]; ok {
+							return db
+						}
+						var db *float64
+						if v, ok := gr.Take(ch); ok {
+							db = decibels(v)
+						}
+						taken[ch] = db
+						return db
+					}
+					for c, ch := range monitor {
+						levels.Channels[c].GainReduction = reduction(ch)
+					}
+					for i := range levels.Inputs {
+						levels.Inputs[i].GainReduction = reduction(levels.Inputs[i].Input)
+					}
+				}
+			}
 			if len(state.Clients) == 0 {
 				state.Mu.RUnlock()
 				continue
 			}
 
+			var spectra *spectrumMessage
+
 			// Build binary packet: [maxL (4B)] [maxR (4B)] [audio samples (4B each)]
 			packetSize := 8 + (len(chunk) * 4)
 			packetBuf := make([]byte, packetSize)
@@ -90,6 +155,17 @@ func StartAudioBroadcaster(state *types.AppState, playbackChan <-chan []float32)
 					// We can't delete here while RLock holds.
 					// The handler loop in server.go handles cleanup on error/close.
 				}
+				if due {
+					c.WriteJSON(levels)
+				}
+				// The FFT only runs when someone subscribed to it
+				if spectrumDue && c.Topics["spectrum"] {
+					if spectra == nil {
+						msg := spectrum.compute()
+						spectra = &msg
+					}
+					c.WriteJSON(spectra)
+				}
 			}
 			state.Mu.RUnlock()
 
@@ -0,0 +1,260 @@
+package web
+
+import (
+	"behringerRecorder/lib/storage"
+	"behringerRecorder/lib/types"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RecordingsHandler serves and manages single recordings at
+// /api/recordings/<name>:
+//
+//	GET     download or play back, with range requests
+//	PATCH   {"name": "new/name.wav", "title": "...", "notes": "...", "tags": [...]}
+//	        rename and/or change metadata; omitted fields are kept
+//	DELETE  move to the trash (see TrashHandler for undo)
+//
+// The take being recorded can't be renamed or deleted. The waveform of a
+// recording is at /api/recordings/<name>/peaks (see servePeaks).
+func RecordingsHandler(state *types.AppState, catalog *storage.Catalog) http.HandlerFunc {
+	store := catalog.Store()
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/recordings/")
+		if rec, ok := strings.CutSuffix(name, "/peaks"); ok {
+			servePeaks(w, r, state, catalog, rec)
+			return
+		}
+		path, err := store.Path(name)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			f, err := store.Open(name)
+			if err != nil {
+				http.Error(w, "File not found", 404)
+				return
+			}
+			defer f.Close()
+			info, err := f.Stat()
+			if err != nil || !info.Mode().IsRegular() {
+				http.Error(w, "File not found", 404)
+				return
+			}
+			http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+
+		case http.MethodPatch:
+			var req struct {
+				Name  *string   `json:"name"`
+				Title *string   `json:"title"`
+				Notes *string   `json:"notes"`
+				Tags  *[]string `json:"tags"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body", 400)
+				return
+			}
+			if isRecordingFile(state, path) {
+				http.Error(w, "Recording is still in progress", 409)
+				return
+			}
+			if req.Name != nil && *req.Name != name {
+				if err := catalog.Rename(name, *req.Name); err != nil {
+					catalogError(w, err)
+					return
+				}
+				fmt.Printf("[FILES] Renamed %s -> %s\n", name, *req.Name)
+				name = *req.Name
+			}
+			if req.Title != nil || req.Notes != nil || req.Tags != nil {
+				rec, _ := catalog.Get(name)
+				m := rec.Metadata
+				if req.Title != nil {
+					m.Title = *req.Title
+				}
+				if req.Notes != nil {
+					m.Notes = *req.Notes
+				}
+				if req.Tags != nil {
+					m.Tags = *req.Tags
+				}
+				if err := catalog.SetMetadata(name, m); err != nil {
+					catalogError(w, err)
+					return
+				}
+			}
+			path, _ = store.Path(name)
+			name, _ = store.Rel(path)
+			rec, _ := catalog.Get(name)
+			json.NewEncoder(w).Encode(rec)
+
+		case http.MethodDelete:
+			if isRecordingFile(state, path) {
+				http.Error(w, "Recording is still in progress", 409)
+				return
+			}
+			entry, err := catalog.Delete(name)
+			if err != nil {
+				catalogError(w, err)
+				return
+			}
+			fmt.Printf("[FILES] Moved %s to the trash (entry %s)\n", entry.Name, entry.ID)
+			json.NewEncoder(w).Encode(entry)
+
+		default:
+			http.Error(w, "Method not allowed", 405)
+		}
+	}
+}
+
+// servePeaks answers GET /api/recordings/<name>/peaks?zoom=<samples per
+// pixel>&format=json|dat with the min/max waveform of a recording, for
+// drawing it without downloading the audio. zoom is at least
+// audiofile.PeakBaseZoom; without it the coarsest stored level is sent. The
+// default JSON and the binary "dat" format are those of audiowaveform:
+//
+//	{"version": 2, "channels": 2, "sample_rate": 48000,
+//	 "samples_per_pixel": 512, "bits": 16, "length": 1000,
+//	 "data": [min, max, ...]}   per pixel, per channel
+func servePeaks(w http.ResponseWriter, r *http.Request, state *types.AppState, catalog *storage.Catalog, name string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	zoom := 0
+	if v := r.URL.Query().Get("zoom"); v != "" {
+		var err error
+		if zoom, err = strconv.Atoi(v); err != nil || zoom < 0 {
+			http.Error(w, "Invalid zoom", 400)
+			return
+		}
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "dat" {
+		http.Error(w, "Invalid format", 400)
+		return
+	}
+	path, err := catalog.Store().Path(name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if isRecordingFile(state, path) {
+		http.Error(w, "Recording is still in progress", 409)
+		return
+	}
+
+	peaks, err := catalog.Peaks(name)
+	switch {
+	case errors.Is(err, storage.ErrInvalidPath):
+		http.Error(w, err.Error(), 400)
+		return
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, err.Error(), 404)
+		return
+	case err != nil:
+		fmt.Printf("[FILES] %v\n", err)
+		http.Error(w, "Failed to read recording", 500)
+		return
+	}
+	level, err := peaks.Level(zoom)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if format == "dat" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		level.WriteTo(w)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Version         int     `json:"version"`
+		Channels        int     `json:"channels"`
+		SampleRate      int     `json:"sample_rate"`
+		SamplesPerPixel int     `json:"samples_per_pixel"`
+		Bits            int     `json:"bits"`
+		Length          int     `json:"length"`
+		Data            []int16 `json:"data"`
+	}{2, level.Channels, level.SampleRate, level.SamplesPerPixel, 16, level.Length(), level.Data})
+}
+
+// TrashHandler serves the trash of deleted recordings:
+//
+//	GET    /api/trash       list entries, most recent first
+//	POST   /api/trash/{id}  restore (undo the delete)
+//	DELETE /api/trash/{id}  delete for good
+func TrashHandler(catalog *storage.Catalog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/trash"), "/")
+		switch {
+		case r.Method == http.MethodGet && id == "":
+			entries, err := catalog.Trash()
+			if err != nil {
+				http.Error(w, "Failed to read trash", 500)
+				return
+			}
+			if entries == nil {
+				entries = []storage.TrashEntry{}
+			}
+			json.NewEncoder(w).Encode(entries)
+
+		case r.Method == http.MethodPost && id != "":
+			entry, err := catalog.Restore(id)
+			if err != nil {
+				catalogError(w, err)
+				return
+			}
+			fmt.Printf("[FILES] Restored %s from the trash\n", entry.Name)
+			json.NewEncoder(w).Encode(entry)
+
+		case r.Method == http.MethodDelete && id != "":
+			if err := catalog.Purge(id); err != nil {
+				catalogError(w, err)
+				return
+			}
+			fmt.Printf("[FILES] Purged trash entry %s\n", id)
+			w.WriteHeader(http.StatusOK)
+
+		default:
+			http.Error(w, "Method not allowed", 405)
+		}
+	}
+}
+
+// catalogError answers a failed catalog operation with the matching status.
+func catalogError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrInvalidPath):
+		http.Error(w, err.Error(), 400)
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, err.Error(), 404)
+	case errors.Is(err, storage.ErrExists):
+		http.Error(w, err.Error(), 409)
+	default:
+		fmt.Printf("[FILES] %v\n", err)
+		http.Error(w, "Failed to update recording", 500)
+	}
+}
+
+// isRecordingFile reports whether path is a file of the take being recorded.
+func isRecordingFile(state *types.AppState, path string) bool {
+	state.Mu.RLock()
+	defer state.Mu.RUnlock()
+	if state.File != nil && state.File.Name() == path {
+		return true
+	}
+	for _, f := range state.TrackFiles {
+		if f.Name() == path {
+			return true
+		}
+	}
+	return false
+}
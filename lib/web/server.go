@@ -3,6 +3,7 @@ package web
 import (
 	"behringerRecorder/lib/config"
 	"behringerRecorder/lib/portaudio"
+	"behringerRecorder/lib/storage"
 	"behringerRecorder/lib/types"
 	"encoding/json"
 	"fmt"
@@ -11,6 +12,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -40,15 +43,36 @@ func DevicesHandler(state *types.AppState) http.HandlerFunc {
 	}
 }
 
-func NewControlHandler(state *types.AppState, cfg *config.Config) http.HandlerFunc {
+func NewControlHandler(state *types.AppState, cfg *config.Config, catalog *storage.Catalog) http.HandlerFunc {
+	store := catalog.Store()
+	// Take numbers per session, kept across restarts
+	takes, err := portaudio.LoadTakeCounter(filepath.Join(store.Dir(), ".takes.json"))
+	if err != nil {
+		fmt.Printf("[RECORDING] Could not load take counters, numbering restarts: %v\n", err)
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		type Req struct {
-			Action   string
-			DeviceID int
-			ChL      *int
-			ChR      *int
-			Folder   string
-			Boost    *float64
+			Action     string
+			DeviceID   int
+			ChL        *int
+			ChR        *int
+			Channels   []int  // Input channels to record; nil keeps the current selection
+			Folder     string // Subfolder of storage_location for "start"
+			Split      *bool  // Record one mono file per channel; nil uses the config default
+			Boost      *float64
+			BitDepth   *string // "16", "24" or "32f" for "start"; nil uses the config default
+			FileFormat *string // "wav" or "flac" for "start"; nil uses the config default
+			Title      string  // Take title for the {title} naming token
+			Session    *string // "session": the new session ("" ends it); "start": overrides it for this take
+
+			// Channel strip of input Channel for "strip"
+			stripChange
+
+			// Broadcast Wave metadata for "start"; nil uses the config defaults
+			Bwf                 *bool
+			Description         *string
+			Originator          *string
+			OriginatorReference *string
 		}
 		var req Req
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -62,25 +86,38 @@ func NewControlHandler(state *types.AppState, cfg *config.Config) http.HandlerFu
 		state.Mu.RUnlock()
 
 		if req.Action == "connect" {
-			// Start engine without holding lock (long operation)
-			err := portaudio.StartAudioEngine(state, cfg, req.DeviceID, state.RecordChan, state.PlaybackChan)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
+			if req.Channels != nil {
+				if err := validateChannels(state, req.DeviceID, req.Channels); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
 			}
-			// Update state
+			// Update routing first so the engine starts with it
 			state.Mu.Lock()
-			state.IsRunning = true
-			state.DeviceID = req.DeviceID
 			if req.ChL != nil {
 				state.ChLeft = *req.ChL
 			}
 			if req.ChR != nil {
 				state.ChRight = *req.ChR
 			}
+			if req.Channels != nil {
+				state.RecordChannels = req.Channels
+			}
 			if req.Boost != nil {
 				state.Boost = *req.Boost
 			}
+			state.PublishParams()
+			state.Mu.Unlock()
+			// Start engine without holding lock (long operation)
+			err := portaudio.StartAudioEngine(state, cfg, req.DeviceID, state.RecordChan, state.PlaybackChan, state.MeterChan)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			// Update state
+			state.Mu.Lock()
+			state.IsRunning = true
+			state.DeviceID = req.DeviceID
 			state.Mu.Unlock()
 			fmt.Printf("[ENGINE] Started with Device ID: %d\n", req.DeviceID)
 			// Notify all clients
@@ -92,32 +129,130 @@ func NewControlHandler(state *types.AppState, cfg *config.Config) http.HandlerFu
 				http.Error(w, "Already recording", 400)
 				return
 			}
-			// Create recording file
-			folder := req.Folder
-			if folder == "" {
-				folder = cfg.StorageLocation
+			// Create recording file(s)
+			split := cfg.SplitTracks
+			if req.Split != nil {
+				split = *req.Split
+			}
+			state.Mu.RLock()
+			channels := state.RecordingChannels()
+			deviceName := ""
+			if state.DeviceID >= 0 && state.DeviceID < len(state.Devices) {
+				deviceName = state.Devices[state.DeviceID].Name
 			}
-			os.MkdirAll(folder, 0755)
-			filename := fmt.Sprintf("rec_%d.wav", time.Now().Unix())
-			base := filepath.Join(folder, filename)
-			file, err := os.Create(base)
+			session := state.Session
+			state.Mu.RUnlock()
+			if req.Session != nil {
+				session = portaudio.SanitizeName(*req.Session)
+			}
+			// Takes of a session are grouped in a subfolder
+			folder, err := store.Folder(filepath.Join(req.Folder, session))
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+
+			bitDepth := cfg.BitDepth
+			if req.BitDepth != nil {
+				bitDepth = *req.BitDepth
+			}
+			bits, float, err := portaudio.ParseBitDepth(bitDepth)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+
+			fileFormat := cfg.FileFormat
+			if req.FileFormat != nil {
+				fileFormat = *req.FileFormat
+			}
+			flac, err := portaudio.ParseFileFormat(fileFormat)
 			if err != nil {
-				fmt.Printf("[RECORDING] START failed - could not create file: %v\n", err)
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if flac && float {
+				http.Error(w, "FLAC does not support 32-bit float", 400)
+				return
+			}
+
+			now := time.Now()
+			format := types.WavFormat{Channels: len(channels), SampleRate: cfg.SampleRate, BitDepth: bits, Float: float, Flac: flac}
+			bwf := cfg.Bwf
+			if req.Bwf != nil {
+				bwf = *req.Bwf
+			}
+			if bwf {
+				description, originator, reference := cfg.BwfDescription, cfg.BwfOriginator, cfg.BwfOriginatorReference
+				if originator == "" {
+					originator = deviceName
+				}
+				if req.Description != nil {
+					description = *req.Description
+				}
+				if req.Originator != nil {
+					originator = *req.Originator
+				}
+				if req.OriginatorReference != nil {
+					reference = *req.OriginatorReference
+				}
+				format.Bext = portaudio.NewBextInfo(description, originator, reference, now, cfg.SampleRate)
+			}
+
+			// Single file: <name>.wav, split-track take:
+			// <name>/<name>_chNN.wav (or .flac), named by the template
+			take := takes.Peek(session)
+			takeName := portaudio.ExpandNameTemplate(cfg.FileNameTemplate, portaudio.TakeNameData{
+				Start:    now,
+				Device:   deviceName,
+				Channels: channels,
+				Take:     take,
+				Title:    req.Title,
+				Session:  session,
+			})
+			takePath := portaudio.UniqueTakePath(filepath.Join(folder, takeName), format.Extension())
+			takeName = filepath.Base(takePath)
+			file, tracks, encoders, err := portaudio.CreateTake(takePath, 1, channels, split, format)
+			if err != nil {
+				fmt.Printf("[RECORDING] START failed - could not create file(s): %v\n", err)
 				http.Error(w, "Failed to create file", 500)
 				return
 			}
-			portaudio.WritePlaceholderHeader(file)
+			// The number is only used up by a take that started
+			if err := takes.Commit(session, take); err != nil {
+				fmt.Printf("[RECORDING] Could not save take counter: %v\n", err)
+			}
+			filename := takeName + format.Extension()
+			if split {
+				filename = takeName + "/"
+			}
 
 			// Update state atomically
 			state.Mu.Lock()
 			state.File = file
+			state.TrackFiles = tracks
+			state.Encoders = encoders
+			state.FileFormat = format
+			state.TakePath = takePath
+			state.TakePart = 1
+			state.TakeNumber = take
 			state.SamplesWrote = 0
+			state.CuePoints = nil
+			state.IsPaused = false
 			state.IsRecording = true
+			state.TakeChannels = channels
 			if req.Boost != nil {
 				state.Boost = *req.Boost
 			}
+			state.PublishParams()
 			state.Mu.Unlock()
-			fmt.Printf("[RECORDING] START - File: %s\n", filename)
+			catalog.Begin(takeFilePaths(file, tracks), storage.Origin{
+				Recorded: now,
+				Device:   deviceName,
+				Session:  session,
+				Take:     take,
+			}, storage.Metadata{Title: req.Title})
+			fmt.Printf("[RECORDING] START - File: %s, Session: %q, Take: %d, Channels: %v, Bit depth: %d\n", filename, session, take, channels, format.BitDepth)
 			// Notify all clients
 			broadcastStateUpdate(state)
 
@@ -127,36 +262,129 @@ func NewControlHandler(state *types.AppState, cfg *config.Config) http.HandlerFu
 				http.Error(w, "Not currently recording", 400)
 				return
 			}
-			// Read file and sample count
-			state.Mu.RLock()
+			// Take the file(s) and sample count and end the take in one
+			// step, so the storage worker can't append after the count is read
+			state.Mu.Lock()
 			file := state.File
+			tracks := state.TrackFiles
+			encoders := state.Encoders
+			format := state.FileFormat
 			samplesWrote := state.SamplesWrote
-			state.Mu.RUnlock()
+			cues := state.CuePoints
+			state.File = nil
+			state.TrackFiles = nil
+			state.Encoders = nil
+			state.CuePoints = nil
+			state.IsPaused = false
+			state.IsRecording = false
+			state.TakeChannels = nil
+			// The recorded inputs follow routing changes made during the take
+			state.PublishParams()
+			state.Mu.Unlock()
 
-			if file == nil {
+			if file == nil && len(tracks) == 0 {
 				fmt.Printf("[RECORDING] STOP failed - no file handle\n")
 				http.Error(w, "No file to finalize", 500)
 				return
 			}
 
-			// Get filename for logging
-			filename := filepath.Base(file.Name())
+			// Finalize file(s) (without lock)
+			var filename string
+			if len(tracks) > 0 {
+				filename = filepath.Base(filepath.Dir(tracks[0].Name())) + "/"
+			} else {
+				filename = filepath.Base(file.Name())
+			}
+			if err := portaudio.FinalizeTake(file, tracks, encoders, format, samplesWrote, cues); err != nil {
+				fmt.Printf("[RECORDING] STOP - could not finalize file: %v\n", err)
+			}
+			// Measuring the peak reads the whole take
+			go catalog.Finish(takeFilePaths(file, tracks))
 
-			// Finalize file (without lock)
-			portaudio.FinalizeWavHeader(file, 2, samplesWrote, cfg.SampleRate)
-			file.Close()
+			fmt.Printf("[RECORDING] STOP - File: %s, Channels: %d, Samples: %d\n", filename, format.Channels, samplesWrote)
+			// Notify all clients
+			broadcastStateUpdate(state)
 
-			// Update state
+		} else if req.Action == "pause" {
 			state.Mu.Lock()
-			state.File = nil
-			state.IsRecording = false
+			if !state.IsRecording || state.IsPaused {
+				state.Mu.Unlock()
+				fmt.Printf("[RECORDING] PAUSE request rejected - not recording or already paused\n")
+				http.Error(w, "Not currently recording or already paused", 400)
+				return
+			}
+			state.IsPaused = true
+			samplesWrote := state.SamplesWrote
+			state.Mu.Unlock()
+			fmt.Printf("[RECORDING] PAUSE - Samples: %d\n", samplesWrote)
+			// Notify all clients
+			broadcastStateUpdate(state)
+
+		} else if req.Action == "resume" {
+			state.Mu.Lock()
+			if !state.IsRecording || !state.IsPaused {
+				state.Mu.Unlock()
+				fmt.Printf("[RECORDING] RESUME request rejected - not paused\n")
+				http.Error(w, "Not currently paused", 400)
+				return
+			}
+			state.IsPaused = false
+			// The storage worker holds the lock while writing, so the
+			// sample count is exactly where the resumed audio begins
+			samplesWrote := state.SamplesWrote
+			if cfg.CueOnResume && samplesWrote > 0 {
+				state.CuePoints = append(state.CuePoints, samplesWrote)
+			}
 			state.Mu.Unlock()
-			fmt.Printf("[RECORDING] STOP - File: %s, Samples: %d\n", filename, samplesWrote)
+			fmt.Printf("[RECORDING] RESUME - Samples: %d\n", samplesWrote)
 			// Notify all clients
 			broadcastStateUpdate(state)
 
-		} else if req.Action == "update" && !isRecording {
-			// Only allow config updates when not recording
+		} else if req.Action == "session" {
+			// Start (or with "" end) a named session; its takes go to a
+			// subfolder of the storage location and are numbered from 1
+			if req.Session == nil {
+				http.Error(w, "Session is required", 400)
+				return
+			}
+			session := portaudio.SanitizeName(*req.Session)
+			state.Mu.Lock()
+			state.Session = session
+			state.Mu.Unlock()
+			fmt.Printf("[RECORDING] SESSION - %q\n", session)
+			broadcastStateUpdate(state)
+
+		} else if req.Action == "strip" {
+			// Allowed while recording: the engine ramps to the new gains
+			if err := applyStripChange(state, req.stripChange); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			broadcastStateUpdate(state)
+
+		} else if req.Action == "resetMeters" {
+			state.Mu.Lock()
+			state.MeterResets++
+			state.Mu.Unlock()
+
+		} else if req.Action == "update" {
+			// The engine applies routing and gain changes live, gains
+			// ramped so they can change mid-take. A take keeps recording the
+			// inputs it started with though.
+			if isRecording && req.Channels != nil {
+				http.Error(w, "The recorded channels can't change during a take", 400)
+				return
+			}
+			state.Mu.RLock()
+			deviceID := state.DeviceID
+			state.Mu.RUnlock()
+			if req.Channels != nil {
+				if err := validateChannels(state, deviceID, req.Channels); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+			}
+
 			state.Mu.Lock()
 			if req.ChL != nil {
 				state.ChLeft = *req.ChL
@@ -164,9 +392,13 @@ func NewControlHandler(state *types.AppState, cfg *config.Config) http.HandlerFu
 			if req.ChR != nil {
 				state.ChRight = *req.ChR
 			}
+			if req.Channels != nil {
+				state.RecordChannels = req.Channels
+			}
 			if req.Boost != nil {
 				state.Boost = *req.Boost
 			}
+			state.PublishParams()
 			state.Mu.Unlock()
 			// Notify all clients
 			broadcastStateUpdate(state)
@@ -174,6 +406,104 @@ func NewControlHandler(state *types.AppState, cfg *config.Config) http.HandlerFu
 	}
 }
 
+// takeFilePaths returns the paths of the file(s) of a take part.
+func takeFilePaths(file *os.File, tracks []*os.File) []string {
+	if file != nil {
+		return []string{file.Name()}
+	}
+	paths := make([]string, len(tracks))
+	for i, f := range tracks {
+		paths[i] = f.Name()
+	}
+	return paths
+}
+
+// validateChannels checks a requested recording channel selection against
+// the inputs of the given device.
+func validateChannels(state *types.AppState, deviceID int, channels []int) error {
+	if len(channels) == 0 {
+		return fmt.Errorf("at least one channel must be selected")
+	}
+	state.Mu.RLock()
+	inputs := 0
+	if deviceID >= 0 && deviceID < len(state.Devices) {
+		inputs = state.Devices[deviceID].Inputs
+	}
+	state.Mu.RUnlock()
+
+	seen := make(map[int]bool, len(channels))
+	for _, c := range channels {
+		if c < 0 || c >= inputs {
+			return fmt.Errorf("channel %d out of range (device has %d inputs)", c, inputs)
+		}
+		if seen[c] {
+			return fmt.Errorf("channel %d selected twice", c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
+
+// stripChange changes the channel strip of one input channel. Fields left
+// out keep their value; a null pan puts the channel back on its side of
+// the monitor pair.
+type stripChange struct {
+	Channel *int            `json:"channel"`
+	Gain    *float64        `json:"gain"` // dB
+	Invert  *bool           `json:"invert"`
+	Mute    *bool           `json:"mute"`
+	Pan     json.RawMessage `json:"pan"`
+}
+
+// applyStripChange validates a strip change and hands it to the engine.
+func applyStripChange(state *types.AppState, change stripChange) error {
+	if change.Channel == nil {
+		return fmt.Errorf("channel is required")
+	}
+	ch := *change.Channel
+	state.Mu.Lock()
+	defer state.Mu.Unlock()
+	inputs := 0
+	if state.DeviceID >= 0 && state.DeviceID < len(state.Devices) {
+		inputs = state.Devices[state.DeviceID].Inputs
+	}
+	if ch < 0 || ch >= inputs {
+		return fmt.Errorf("channel %d out of range (device has %d inputs)", ch, inputs)
+	}
+
+	strip := state.ChannelStrips()[ch]
+	if change.Gain != nil {
+		if *change.Gain < -60 || *change.Gain > 24 {
+			return fmt.Errorf("gain must be from -60 to 24 dB")
+		}
+		strip.Gain = *change.Gain
+	}
+	if change.Invert != nil {
+		strip.Invert = *change.Invert
+	}
+	if change.Mute != nil {
+		strip.Mute = *change.Mute
+	}
+	if len(change.Pan) > 0 {
+		var pan *float64
+		if err := json.Unmarshal(change.Pan, &pan); err != nil {
+			return fmt.Errorf("invalid pan")
+		}
+		if pan != nil && (*pan < -1 || *pan > 1) {
+			return fmt.Errorf("pan must be from -1 to 1")
+		}
+		strip.Pan = pan
+	}
+	state.SetChannelStrip(ch, strip)
+
+	pan := "as routed"
+	if strip.Pan != nil {
+		pan = strconv.FormatFloat(*strip.Pan, 'f', 2, 64)
+	}
+	fmt.Printf("[ENGINE] STRIP - Channel: %d, Gain: %.1f dB, Invert: %v, Mute: %v, Pan: %s\n", ch, strip.Gain, strip.Invert, strip.Mute, pan)
+	return nil
+}
+
 func NewStatusHandler(state *types.AppState, cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		state.Mu.RLock()
@@ -181,58 +511,143 @@ func NewStatusHandler(state *types.AppState, cfg *config.Config) http.HandlerFun
 		status := struct {
 			IsRunning          bool    `json:"isRunning"`
 			IsRecording        bool    `json:"isRecording"`
+			IsPaused           bool    `json:"isPaused"`
+			Session            string  `json:"session"`
+			TakeNumber         int     `json:"takeNumber"`
 			ChL                int     `json:"chL"`
 			ChR                int     `json:"chR"`
+			Channels           []int   `json:"channels"`
 			Boost              float64 `json:"boost"`
 			DeviceId           int     `json:"deviceId"`
 			StorageLocation    string  `json:"storageLocation"`
 			CloudDriveLocation string  `json:"cloudDriveLocation"`
+
+			Strips map[int]types.ChannelStrip `json:"strips"` // By input channel, only those changed
 		}{
 			IsRunning:          state.IsRunning,
 			IsRecording:        state.IsRecording,
+			IsPaused:           state.IsPaused,
+			Session:            state.Session,
+			TakeNumber:         state.TakeNumber,
 			ChL:                state.ChLeft,
 			ChR:                state.ChRight,
+			Channels:           state.RecordingChannels(),
 			Boost:              state.Boost,
 			DeviceId:           state.DeviceID,
 			StorageLocation:    state.StorageLocation,
 			CloudDriveLocation: state.CloudDriveLocation,
+			Strips:             state.ChannelStrips(),
 		}
 		json.NewEncoder(w).Encode(status)
 	}
 }
 
-func FilesHandler(cfg *config.Config) http.HandlerFunc {
+// FilesHandler lists the recordings from the index, after a quick scan for
+// files added or removed behind its back (see Catalog.Sync). Query
+// parameters:
+//
+//	q       text to find in the name, title, notes, tags, session or device
+//	tag     only recordings with this tag (repeat for several)
+//	session only recordings of this session
+//	format  "wav" or "flac"
+//	from    recorded at or after, 2006-01-02 or RFC 3339
+//	to      recorded before; a plain date includes that day
+//	sort    name (default), recorded, size, duration or peak; "-" prefix descends
+//	offset  recordings to skip
+//	limit   recordings per page; all when omitted
+//
+// The body stays a plain array; the number of all matches is sent in the
+// X-Total-Count header for paging.
+func FilesHandler(catalog *storage.Catalog) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		files, err := os.ReadDir(cfg.StorageLocation)
-		if err != nil {
-			http.Error(w, "Failed to read recordings directory", 500)
+		params := r.URL.Query()
+		q := storage.Query{
+			Search:  params.Get("q"),
+			Tags:    params["tag"],
+			Session: params.Get("session"),
+			Format:  params.Get("format"),
+			Sort:    params.Get("sort"),
+		}
+		q.Sort, q.Desc = strings.CutPrefix(q.Sort, "-")
+		var err error
+		if q.From, err = parseDateParam(params.Get("from"), false); err != nil {
+			http.Error(w, "Invalid from: "+err.Error(), 400)
 			return
 		}
-
-		type FileInfo struct {
-			Name    string    `json:"name"`
-			Size    int64     `json:"size"`
-			ModTime time.Time `json:"modTime"`
+		if q.To, err = parseDateParam(params.Get("to"), true); err != nil {
+			http.Error(w, "Invalid to: "+err.Error(), 400)
+			return
 		}
-
-		var list []FileInfo
-		for _, f := range files {
-			if !f.IsDir() && filepath.Ext(f.Name()) == ".wav" {
-				info, err := f.Info()
-				if err == nil {
-					list = append(list, FileInfo{
-						Name:    f.Name(),
-						Size:    info.Size(),
-						ModTime: info.ModTime(),
-					})
+		for key, dst := range map[string]*int{"offset": &q.Offset, "limit": &q.Limit} {
+			if v := params.Get(key); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					http.Error(w, "Invalid "+key, 400)
+					return
 				}
+				*dst = n
 			}
 		}
+
+		// Pick up files added behind the index's back, e.g. copied in
+		if err := catalog.Sync(); err != nil {
+			fmt.Printf("[FILES] Could not scan recordings: %v\n", err)
+		}
+		list, total, err := catalog.Find(q)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if list == nil {
+			list = []storage.Recording{}
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
 		json.NewEncoder(w).Encode(list)
 	}
 }
 
-func PushHandler(cfg *config.Config) http.HandlerFunc {
+// parseDateParam parses a date filter: RFC 3339, or a plain date in local
+// time. With endOfDay a plain date means the end of that day, so "to" is
+// inclusive.
+func parseDateParam(s string, endOfDay bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("want 2006-01-02 or RFC 3339")
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// RescanHandler updates the index from the files in the storage, for files
+// added or changed outside the app, and answers with the number of indexed
+// recordings.
+func RescanHandler(catalog *storage.Catalog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+		if err := catalog.Rescan(); err != nil {
+			http.Error(w, "Failed to scan recordings: "+err.Error(), 500)
+			return
+		}
+		_, total, _ := catalog.Find(storage.Query{})
+		fmt.Printf("[FILES] Rescanned, %d recordings\n", total)
+		json.NewEncoder(w).Encode(map[string]int{"recordings": total})
+	}
+}
+
+// PushHandler copies a recording (source, relative to storage_location) to
+// the cloud drive folder (target, relative to cloud_drive_location).
+func PushHandler(recordings, cloud *storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
 			Source string `json:"source"`
@@ -242,25 +657,29 @@ func PushHandler(cfg *config.Config) http.HandlerFunc {
 			http.Error(w, "Invalid request", 400)
 			return
 		}
-
-		sourcePath := filepath.Join(cfg.StorageLocation, req.Source)
-		targetPath := filepath.Join(cfg.CloudDriveLocation, req.Target)
-
-		// Ensure target directory exists
-		if err := os.MkdirAll(cfg.CloudDriveLocation, 0755); err != nil {
-			http.Error(w, "Failed to create target directory", 500)
+		if _, err := recordings.Path(req.Source); err != nil {
+			http.Error(w, "Invalid source: "+err.Error(), 400)
+			return
+		}
+		if _, err := cloud.Path(req.Target); err != nil {
+			http.Error(w, "Invalid target: "+err.Error(), 400)
 			return
 		}
 
 		// Copy file
-		src, err := os.Open(sourcePath)
+		src, err := recordings.Open(req.Source)
 		if err != nil {
 			http.Error(w, "Source file not found", 404)
 			return
 		}
 		defer src.Close()
+		if info, err := src.Stat(); err != nil || !info.Mode().IsRegular() {
+			http.Error(w, "Source file not found", 404)
+			return
+		}
 
-		dst, err := os.Create(targetPath)
+		// Creates the target directory if needed
+		dst, err := cloud.Create(req.Target)
 		if err != nil {
 			http.Error(w, "Failed to create destination file", 500)
 			return
@@ -348,7 +767,9 @@ func NewWSHandler(state *types.AppState) http.HandlerFunc {
 
 				// Handle incoming messages from clients
 				var msg struct {
-					Type string `json:"type"`
+					Type   string   `json:"type"`
+					Topics []string `json:"topics"`
+					stripChange
 				}
 				if err := json.Unmarshal(data, &msg); err != nil {
 					continue
@@ -373,6 +794,30 @@ func NewWSHandler(state *types.AppState) http.HandlerFunc {
 					// Notify all clients of the change
 					fmt.Printf("[PRIMARY] New PRIMARY assigned: %p\n", wsClient)
 					broadcastStateUpdate(state)
+				} else if msg.Type == "subscribe" || msg.Type == "unsubscribe" {
+					// Opt in to (or out of) optional message types:
+					// {"type": "subscribe", "topics": ["spectrum"]}
+					state.Mu.Lock()
+					if wsClient.Topics == nil {
+						wsClient.Topics = make(map[string]bool)
+					}
+					for _, t := range msg.Topics {
+						if msg.Type == "subscribe" {
+							wsClient.Topics[t] = true
+						} else {
+							delete(wsClient.Topics, t)
+						}
+					}
+					state.Mu.Unlock()
+				} else if msg.Type == "strip" {
+					// Same as the "strip" control action:
+					// {"type": "strip", "channel": 2, "gain": -6, "invert": true}
+					if err := applyStripChange(state, msg.stripChange); err != nil {
+						wsClient.Conn.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+						wsClient.WriteJSON(map[string]string{"type": "error", "error": err.Error()})
+						continue
+					}
+					broadcastStateUpdate(state)
 				}
 			}
 		}()
@@ -387,24 +832,35 @@ func sendConfigStateUpdate(ws *types.WSClient, state *types.AppState) {
 		Type               string  `json:"type"`
 		IsRunning          bool    `json:"isRunning"`
 		IsRecording        bool    `json:"isRecording"`
+		IsPaused           bool    `json:"isPaused"`
 		IsPrimary          bool    `json:"isPrimary"`
+		Session            string  `json:"session"`
+		TakeNumber         int     `json:"takeNumber"`
 		DeviceID           int     `json:"deviceId"`
 		ChL                int     `json:"chL"`
 		ChR                int     `json:"chR"`
+		Channels           []int   `json:"channels"`
 		Boost              float64 `json:"boost"`
 		StorageLocation    string  `json:"storageLocation"`
 		CloudDriveLocation string  `json:"cloudDriveLocation"`
+
+		Strips map[int]types.ChannelStrip `json:"strips"` // By input channel, only those changed
 	}{
 		Type:               "state",
 		IsRunning:          state.IsRunning,
 		IsRecording:        state.IsRecording,
+		IsPaused:           state.IsPaused,
 		IsPrimary:          state.PrimaryClient == ws,
+		Session:            state.Session,
+		TakeNumber:         state.TakeNumber,
 		DeviceID:           state.DeviceID,
 		ChL:                state.ChLeft,
 		ChR:                state.ChRight,
+		Channels:           state.RecordingChannels(),
 		Boost:              state.Boost,
 		StorageLocation:    state.StorageLocation,
 		CloudDriveLocation: state.CloudDriveLocation,
+		Strips:             state.ChannelStrips(),
 	}
 	state.Mu.RUnlock()
 
@@ -422,3 +878,50 @@ func broadcastStateUpdate(state *types.AppState) {
 		sendConfigStateUpdate(c, state)
 	}
 }
+
+// RolloverNotifier returns the storage worker callback that announces a new
+// part of a long take to all clients, and moves the take in the index on to
+// the new part:
+//
+//	{"type": "rollover", "part": 2, "samples": 172800000,
+//	 "previous": ["rec_1700000000.wav"], "files": ["rec_1700000000_part002.wav"]}
+func RolloverNotifier(state *types.AppState, catalog *storage.Catalog) func(portaudio.RolloverEvent) {
+	return func(ev portaudio.RolloverEvent) {
+		fmt.Printf("[RECORDING] ROLLOVER - Part: %d, Files: %v, Previous samples: %d\n", ev.Part, ev.Files, ev.Samples)
+		msg := struct {
+			Type string `json:"type"`
+			portaudio.RolloverEvent
+		}{"rollover", ev}
+
+		state.Mu.RLock()
+		folder := filepath.Dir(state.TakePath)
+		sampleRate := state.FileFormat.SampleRate
+		for c := range state.Clients {
+			c.Conn.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+			c.WriteJSON(msg)
+		}
+		state.Mu.RUnlock()
+
+		paths := func(names []string) []string {
+			out := make([]string, len(names))
+			for i, name := range names {
+				out[i] = filepath.Join(folder, filepath.FromSlash(name))
+			}
+			return out
+		}
+		// The new part continues where the previous one ended
+		var prev storage.Recording
+		if len(ev.Previous) > 0 {
+			if name, err := catalog.Store().Rel(paths(ev.Previous)[0]); err == nil {
+				prev, _ = catalog.Get(name)
+			}
+		}
+		origin := prev.Origin
+		if sampleRate > 0 && !origin.Recorded.IsZero() {
+			seconds := float64(ev.Samples) / float64(sampleRate)
+			origin.Recorded = origin.Recorded.Add(time.Duration(seconds * float64(time.Second)))
+		}
+		catalog.Begin(paths(ev.Files), origin, storage.Metadata{Title: prev.Title})
+		go catalog.Finish(paths(ev.Previous))
+	}
+}
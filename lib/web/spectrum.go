@@ -0,0 +1,203 @@
+package web
+
+import (
+	"behringerRecorder/lib/config"
+	"cmp"
+	"math"
+	"math/bits"
+)
+
+const (
+	spectrumVersion = 1
+
+	// Defaults for the spectrum_* config keys left at 0
+	defaultSpectrumRate    = 10
+	defaultSpectrumFFTSize = 4096
+	defaultSpectrumBands   = 96
+
+	spectrumMinFreq = 20.0
+	spectrumMaxFreq = 20000.0
+	spectrumFloor   = -140.0 // dBFS reported for bands quieter than this
+)
+
+// spectrumMessage is sent to the clients subscribed to "spectrum" at
+// spectrum_rate updates per second (at most once per audio buffer):
+//
+//	{"type": "spectrum", "version": 1, "fftSize": 4096,
+//	 "frequencies": [20.4, 21.7, ...],          band centers in Hz
+//	 "channels": [[-92.1, -88.4, ...], [...]]}  per monitor channel, dBFS
+//
+// The bands are spaced logarithmically from 20 Hz to 20 kHz (or the Nyquist
+// frequency). Each holds the strongest FFT bin within it, scaled so that a
+// full scale sine reads 0 dBFS whatever the band width; narrow low bands
+// between two bins read the nearest one.
+type spectrumMessage struct {
+	Type        string      `json:"type"`
+	Version     int         `json:"version"`
+	FFTSize     int         `json:"fftSize"`
+	Frequencies []float64   `json:"frequencies"`
+	Channels    [][]float64 `json:"channels"`
+}
+
+// spectrumBand is the FFT bins [lo, hi) of one band.
+type spectrumBand struct {
+	lo, hi int
+}
+
+// spectrumAnalyser computes Hann windowed FFT spectra of the last fftSize
+// frames of the monitor pair. It is used by the broadcaster goroutine only.
+type spectrumAnalyser struct {
+	channels int
+	size     int
+	hist     [][]float32 // Per channel, a ring of the last size samples
+	pos      int         // Next write position in hist
+	interval int         // Frames per update
+	frames   int         // Frames since the last update
+
+	window []float64
+	scale  float64 // Bin magnitude to full scale sine amplitude
+	bands  []spectrumBand
+	freqs  []float64
+	fft    *fft
+}
+
+func newSpectrumAnalyser(channels int, cfg *config.Config) *spectrumAnalyser {
+	rate := cmp.Or(cfg.SpectrumRate, defaultSpectrumRate)
+	size := cmp.Or(cfg.SpectrumFFTSize, defaultSpectrumFFTSize)
+	count := cmp.Or(cfg.SpectrumBands, defaultSpectrumBands)
+	a := &spectrumAnalyser{
+		channels: channels,
+		size:     size,
+		hist:     make([][]float32, channels),
+		interval: max(int(float64(cfg.SampleRate)/rate), 1),
+		window:   make([]float64, size),
+		fft:      newFFT(size),
+	}
+	for c := range a.hist {
+		a.hist[c] = make([]float32, size)
+	}
+	var sum float64
+	for i := range a.window {
+		a.window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(size))
+		sum += a.window[i]
+	}
+	a.scale = 2 / sum
+
+	// Log spaced band edges, each band at least the bin nearest its center
+	binHz := float64(cfg.SampleRate) / float64(size)
+	top := min(spectrumMaxFreq, float64(cfg.SampleRate)/2)
+	edge := func(i int) float64 {
+		return spectrumMinFreq * math.Pow(top/spectrumMinFreq, float64(i)/float64(count))
+	}
+	for i := range count {
+		lo, hi := edge(i), edge(i+1)
+		center := math.Sqrt(lo * hi)
+		b := spectrumBand{int(math.Ceil(lo / binHz)), int(math.Ceil(hi / binHz))}
+		if b.hi <= b.lo {
+			b.lo = int(math.Round(center / binHz))
+			b.hi = b.lo + 1
+		}
+		b.hi = min(b.hi, size/2+1)
+		a.bands = append(a.bands, b)
+		a.freqs = append(a.freqs, math.Round(center*10)/10)
+	}
+	return a
+}
+
+// add keeps an interleaved chunk and reports whether an update is due.
+func (a *spectrumAnalyser) add(chunk []float32) bool {
+	frames := len(chunk) / a.channels
+	for i := range frames {
+		for c := range a.channels {
+			a.hist[c][a.pos] = chunk[i*a.channels+c]
+		}
+		a.pos = (a.pos + 1) % a.size
+	}
+	if a.frames += frames; a.frames < a.interval {
+		return false
+	}
+	a.frames = 0
+	return true
+}
+
+// compute returns the spectra of the kept audio.
+func (a *spectrumAnalyser) compute() spectrumMessage {
+	msg := spectrumMessage{
+		Type:        "spectrum",
+		Version:     spectrumVersion,
+		FFTSize:     a.size,
+		Frequencies: a.freqs,
+		Channels:    make([][]float64, a.channels),
+	}
+	for c := range a.channels {
+		re, im := a.fft.re, a.fft.im
+		for i := range a.size {
+			re[i] = float64(a.hist[c][(a.pos+i)%a.size]) * a.window[i]
+			im[i] = 0
+		}
+		a.fft.transform()
+
+		levels := make([]float64, len(a.bands))
+		for i, b := range a.bands {
+			var peak float64
+			for k := b.lo; k < b.hi; k++ {
+				peak = max(peak, math.Hypot(re[k], im[k]))
+			}
+			db := max(20*math.Log10(peak*a.scale), spectrumFloor)
+			levels[i] = math.Round(db*10) / 10
+		}
+		msg.Channels[c] = levels
+	}
+	return msg
+}
+
+// fft is an in-place iterative radix-2 FFT of a fixed power of two size.
+type fft struct {
+	re, im     []float64
+	cos, sin   []float64 // Twiddle factors for size/2 angles
+	reverse    []int     // Bit reversed index of each position
+	size, bits int
+}
+
+func newFFT(size int) *fft {
+	f := &fft{
+		re:      make([]float64, size),
+		im:      make([]float64, size),
+		cos:     make([]float64, size/2),
+		sin:     make([]float64, size/2),
+		reverse: make([]int, size),
+		size:    size,
+		bits:    bits.TrailingZeros(uint(size)),
+	}
+	for i := range f.cos {
+		angle := -2 * math.Pi * float64(i) / float64(size)
+		f.cos[i], f.sin[i] = math.Cos(angle), math.Sin(angle)
+	}
+	for i := range f.reverse {
+		f.reverse[i] = int(bits.Reverse(uint(i)) >> (bits.UintSize - f.bits))
+	}
+	return f
+}
+
+func (f *fft) transform() {
+	re, im := f.re, f.im
+	for i, j := range f.reverse {
+		if i < j {
+			re[i], re[j] = re[j], re[i]
+			im[i], im[j] = im[j], im[i]
+		}
+	}
+	for half := 1; half < f.size; half *= 2 {
+		step := f.size / (2 * half)
+		for start := 0; start < f.size; start += 2 * half {
+			for k := range half {
+				wr, wi := f.cos[k*step], f.sin[k*step]
+				a, b := start+k, start+k+half
+				tr := re[b]*wr - im[b]*wi
+				ti := re[b]*wi + im[b]*wr
+				re[b], im[b] = re[a]-tr, im[a]-ti
+				re[a], im[a] = re[a]+tr, im[a]+ti
+			}
+		}
+	}
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"behringerRecorder/lib/config"
 	"behringerRecorder/lib/portaudio"
+	"behringerRecorder/lib/portaudio/hardware"
+	"behringerRecorder/lib/storage"
 	"behringerRecorder/lib/types"
 	"behringerRecorder/lib/web"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"mime"
 	"net/http"
 	"path/filepath"
 
@@ -28,6 +31,27 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error loading config: %v", err)
 	}
+	_, float, err := portaudio.ParseBitDepth(cfg.BitDepth)
+	if err != nil {
+		log.Fatalf("Error in config: %v", err)
+	}
+	if flac, err := portaudio.ParseFileFormat(cfg.FileFormat); err != nil {
+		log.Fatalf("Error in config: %v", err)
+	} else if flac && float {
+		log.Fatalf("Error in config: file_format flac does not support bit_depth 32f")
+	}
+	if _, err := portaudio.ParseDither(cfg.Dither); err != nil {
+		log.Fatalf("Error in config: %v", err)
+	}
+	if n := cfg.SpectrumFFTSize; n != 0 && (n < 256 || n > 65536 || n&(n-1) != 0) {
+		log.Fatalf("Error in config: spectrum_fft_size must be a power of two from 256 to 65536")
+	}
+	if cfg.SpectrumRate < 0 || cfg.SpectrumBands < 0 {
+		log.Fatalf("Error in config: spectrum_rate and spectrum_bands can't be negative")
+	}
+	if cfg.LimiterCeiling < -20 || cfg.LimiterCeiling > 0 || cfg.LimiterReleaseMs < 0 {
+		log.Fatalf("Error in config: limiter_ceiling must be from -20 to 0 dBFS and limiter_release_ms can't be negative")
+	}
 	if abs, err := filepath.Abs(cfg.StorageLocation); err == nil {
 		cfg.StorageLocation = abs
 	}
@@ -38,25 +62,52 @@ func main() {
 	fmt.Printf("[CONFIG] Loaded: L:%d, R:%d, Boost:%.1f, Storage:%s\n",
 		cfg.DefaultChL, cfg.DefaultChR, cfg.DefaultBoost, cfg.StorageLocation)
 
-	pa.Initialize()
-	defer pa.Terminate()
+	// Recover takes left unfinalized by a crash or power loss
+	if repaired := portaudio.RepairWavFiles(cfg.StorageLocation, cfg.SampleRate); len(repaired) > 0 {
+		fmt.Printf("[RECOVERY] Repaired %d unfinalized recording(s)\n", len(repaired))
+	}
 
 	state := &types.AppState{
 		Clients:            make(map[*types.WSClient]bool),
 		ChLeft:             cfg.DefaultChL,
 		ChRight:            cfg.DefaultChR,
 		Boost:              cfg.DefaultBoost,
+		RecordChannels:     cfg.DefaultChannels,
 		RecordChan:         make(chan []float32, 100),
 		PlaybackChan:       make(chan []float32, 100),
+		MeterChan:          make(chan []float32, 100),
 		StorageLocation:    cfg.StorageLocation,
 		CloudDriveLocation: cfg.CloudDriveLocation,
 	}
 
-	state.Devices, _ = pa.Devices()
+	if cfg.Source == "" || cfg.Source == portaudio.SourcePortAudio {
+		pa.Initialize()
+		defer pa.Terminate()
+		state.Devices, _ = hardware.Devices()
+	} else {
+		// Software sources (synthetic / file replay) need no sound card.
+		state.Devices, err = portaudio.VirtualDevices(cfg)
+		if err != nil {
+			log.Fatalf("Error initializing %s audio source: %v", cfg.Source, err)
+		}
+	}
+
+	// All request paths are confined to these folders
+	recordings := storage.New(cfg.StorageLocation)
+	cloud := storage.New(cfg.CloudDriveLocation)
+	catalog, err := storage.OpenCatalog(recordings)
+	if err != nil {
+		fmt.Printf("[FILES] Could not load the recordings index: %v\n", err)
+	}
+	go func() {
+		if err := catalog.Rescan(); err != nil {
+			fmt.Printf("[FILES] Could not scan recordings: %v\n", err)
+		}
+	}()
 
 	// Start workers
-	web.StartAudioBroadcaster(state, state.PlaybackChan)
-	portaudio.StartStorageWorker(state, state.RecordChan)
+	web.StartAudioBroadcaster(state, cfg, state.PlaybackChan, state.MeterChan)
+	portaudio.StartStorageWorker(state, cfg, state.RecordChan, web.RolloverNotifier(state, catalog))
 
 	tmpl := template.Must(template.ParseFiles("static/index.html"))
 
@@ -75,11 +126,19 @@ func main() {
 	})
 
 	http.HandleFunc("/api/devices", web.DevicesHandler(state))
-	http.Handle("/api/recordings/", http.StripPrefix("/api/recordings/", http.FileServer(http.Dir(cfg.StorageLocation))))
-	http.HandleFunc("/api/files", web.FilesHandler(cfg))
+	// Go's built-in table lacks FLAC and content sniffing doesn't detect it
+	mime.AddExtensionType(".flac", "audio/flac")
+	http.HandleFunc("/api/recordings/", web.RecordingsHandler(state, catalog))
+	http.HandleFunc("/api/files", web.FilesHandler(catalog))
+	http.HandleFunc("/api/files/rescan", web.RescanHandler(catalog))
+	http.HandleFunc("/api/trash", web.TrashHandler(catalog))
+	http.HandleFunc("/api/trash/", web.TrashHandler(catalog))
 	http.HandleFunc("/api/status", web.NewStatusHandler(state, cfg))
-	http.HandleFunc("/api/control", web.NewControlHandler(state, cfg))
-	http.HandleFunc("/api/push", web.PushHandler(cfg))
+	http.HandleFunc("/api/control", web.NewControlHandler(state, cfg, catalog))
+	http.HandleFunc("/api/push", web.PushHandler(recordings, cloud))
+	jobs := web.NewJobManager(state, cfg, catalog)
+	http.HandleFunc("/api/jobs", web.JobsHandler(jobs))
+	http.HandleFunc("/api/jobs/", web.JobsHandler(jobs))
 	http.HandleFunc("/ws", web.NewWSHandler(state))
 
 	PrintGreen(fmt.Sprintf("UI: http://%s:%s", web.GetLocalIP(), cfg.Port))